@@ -0,0 +1,264 @@
+package tinyrpc
+
+//认证和授权：客户端在Option握手中或在每次调用的metadata中携带凭证，
+//服务端用Authenticator验证凭证得到调用者Principal，再用Authorizer决定它能否调用Service.Method
+//认证失败返回错误码Unauthenticated，没有权限返回PermissionDenied
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Principal 通过认证的调用者
+type Principal struct {
+	Name string
+	// 认证方式，如"token"、"hmac"、"tls"
+	AuthType string
+}
+
+// AuthInfo 认证时可以使用的信息
+type AuthInfo struct {
+	ServiceMethod string
+	// 客户端在Option.Credentials中携带的连接级凭证
+	Credentials Metadata
+	// 请求的metadata，包括Option.CallCredentials生成的凭证
+	Metadata Metadata
+	// TLS连接的状态，不是TLS连接时为nil
+	TLS *tls.ConnectionState
+}
+
+// Authenticator 验证调用者的凭证
+//每个请求在调用方法前都会经过Authenticate，返回的错误没有错误码时会被当作Unauthenticated
+type Authenticator interface {
+	Authenticate(ctx context.Context, info *AuthInfo) (*Principal, error)
+}
+
+// AuthenticatorFunc 把函数转换为Authenticator
+type AuthenticatorFunc func(ctx context.Context, info *AuthInfo) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, info *AuthInfo) (*Principal, error) {
+	return f(ctx, info)
+}
+
+// Authorizer 决定调用者能否调用serviceMethod
+//返回的错误没有错误码时会被当作PermissionDenied
+type Authorizer interface {
+	Authorize(ctx context.Context, p *Principal, serviceMethod string) error
+}
+
+// AuthorizerFunc 把函数转换为Authorizer
+type AuthorizerFunc func(ctx context.Context, p *Principal, serviceMethod string) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, p *Principal, serviceMethod string) error {
+	return f(ctx, p, serviceMethod)
+}
+
+// CallCredentials 客户端为每次调用生成凭证，结果会合并到请求的metadata中
+type CallCredentials func(ctx context.Context, serviceMethod string) (Metadata, error)
+
+// WithAuthenticator 设置服务端的Authenticator
+func WithAuthenticator(a Authenticator) ServerOption {
+	return func(server *Server) {
+		server.authn = a
+	}
+}
+
+// WithAuthorizer 设置服务端的Authorizer，没有设置Authenticator时Principal为nil
+func WithAuthorizer(a Authorizer) ServerOption {
+	return func(server *Server) {
+		server.authz = a
+	}
+}
+
+type principalKey struct{}
+type credentialsKey struct{}
+
+// PrincipalFromContext 返回服务端方法的调用者
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// authenticate 认证和授权一个请求，返回附带了Principal的ctx
+func (server *Server) authenticate(ctx context.Context, serviceMethod string) (context.Context, error) {
+	var p *Principal
+	if server.authn != nil {
+		info := &AuthInfo{ServiceMethod: serviceMethod}
+		info.Credentials, _ = ctx.Value(credentialsKey{}).(Metadata)
+		info.Metadata, _ = FromIncomingContext(ctx)
+		info.TLS, _ = TLSConnectionState(ctx)
+		var err error
+		if p, err = server.authn.Authenticate(ctx, info); err != nil {
+			return ctx, withCode(err, Unauthenticated)
+		}
+		ctx = context.WithValue(ctx, principalKey{}, p)
+	}
+	if server.authz != nil {
+		if err := server.authz.Authorize(ctx, p, serviceMethod); err != nil {
+			return ctx, withCode(err, PermissionDenied)
+		}
+	}
+	return ctx, nil
+}
+
+// withCode 给没有错误码的err加上code
+func withCode(err error, code Code) error {
+	if errors.As(err, new(*StatusError)) {
+		return err
+	}
+	return &StatusError{Code: code, Message: "rpc r: " + err.Error()}
+}
+
+// TokenAuthenticator 用静态的token认证，tokens的键为token，值为调用者的名字
+//token可以放在Option.Credentials或请求metadata的"token"中，请求中的优先
+//token以明文传输，没有TLS时可能被窃听后重放，应当配合TLS使用
+func TokenAuthenticator(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, info *AuthInfo) (*Principal, error) {
+		token := info.Metadata["token"]
+		if token == "" {
+			token = info.Credentials["token"]
+		}
+		name, ok := tokens[token]
+		if token == "" || !ok {
+			return nil, errors.New("invalid token")
+		}
+		return &Principal{Name: name, AuthType: "token"}, nil
+	})
+}
+
+// TLSAuthenticator 用经过验证的客户端证书认证，调用者的名字为证书的CommonName
+//服务端的tls.Config需要要求并验证客户端证书
+func TLSAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, info *AuthInfo) (*Principal, error) {
+		cert := PeerCertificate(ctx)
+		if cert == nil {
+			return nil, errors.New("no verified client certificate")
+		}
+		return &Principal{Name: cert.Subject.CommonName, AuthType: "tls"}, nil
+	})
+}
+
+// HMAC凭证使用的metadata键
+const (
+	hmacKeyID     = "hmac-key-id"
+	hmacTimestamp = "hmac-timestamp"
+	hmacNonce     = "hmac-nonce"
+	hmacSignature = "hmac-signature"
+)
+
+func hmacSign(secret []byte, serviceMethod, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(serviceMethod + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HMACCredentials 用secret对每次调用的方法名、时间和一个随机数签名
+//签名不包括调用的参数，没有TLS时参数可能在传输中被篡改，需要完整性保护时应当配合TLS使用
+func HMACCredentials(keyID string, secret []byte) CallCredentials {
+	return func(ctx context.Context, serviceMethod string) (Metadata, error) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(b)
+		return Metadata{
+			hmacKeyID:     keyID,
+			hmacTimestamp: ts,
+			hmacNonce:     nonce,
+			hmacSignature: hmacSign(secret, serviceMethod, ts, nonce),
+		}, nil
+	}
+}
+
+// nonceCache 记录maxSkew内见过的随机数，同一个签名只能使用一次
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// use 记录nonce，nonce已经使用过时返回false
+func (c *nonceCache) use(nonce string, maxSkew time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) >= maxSkew {
+		//超过2*maxSkew的签名一定已经过期，不需要再记录
+		for n, t := range c.seen {
+			if now.Sub(t) > 2*maxSkew {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// HMACAuthenticator 验证HMACCredentials生成的签名，keys的键为keyID，调用者的名字为keyID
+//签名时间与服务端时间相差超过maxSkew时拒绝，maxSkew内重复使用的签名也会被拒绝，防止签名被重放；
+//记录的随机数只在一个服务端进程内有效，多个服务端共享同一组keys时签名仍然可以发往另一个服务端重放
+func HMACAuthenticator(keys map[string][]byte, maxSkew time.Duration) Authenticator {
+	nonces := &nonceCache{seen: make(map[string]time.Time)}
+	return AuthenticatorFunc(func(ctx context.Context, info *AuthInfo) (*Principal, error) {
+		keyID := info.Metadata[hmacKeyID]
+		secret, ok := keys[keyID]
+		if keyID == "" || !ok {
+			return nil, errors.New("unknown hmac key")
+		}
+		ts, nonce := info.Metadata[hmacTimestamp], info.Metadata[hmacNonce]
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || nonce == "" {
+			return nil, errors.New("invalid hmac timestamp or nonce")
+		}
+		if skew := time.Since(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+			return nil, errors.New("hmac signature expired")
+		}
+		expected := hmacSign(secret, info.ServiceMethod, ts, nonce)
+		if !hmac.Equal([]byte(expected), []byte(info.Metadata[hmacSignature])) {
+			return nil, errors.New("invalid hmac signature")
+		}
+		if !nonces.use(keyID+"/"+nonce, maxSkew) {
+			return nil, errors.New("hmac signature replayed")
+		}
+		return &Principal{Name: keyID, AuthType: "hmac"}, nil
+	})
+}
+
+// ACL 按方法授权的策略，键为"Service.Method"、"Service.*"或"*"，值为允许调用的调用者名字，"*"表示任何调用者
+//查找时依次匹配方法、服务和"*"，都没有匹配时拒绝
+type ACL map[string][]string
+
+func (acl ACL) Authorize(ctx context.Context, p *Principal, serviceMethod string) error {
+	names, ok := acl[serviceMethod]
+	if !ok {
+		service := serviceMethod
+		if i := strings.LastIndex(serviceMethod, "."); i >= 0 {
+			service = serviceMethod[:i]
+		}
+		if names, ok = acl[service+".*"]; !ok {
+			names = acl["*"]
+		}
+	}
+	for _, name := range names {
+		if name == "*" || (p != nil && name == p.Name) {
+			return nil
+		}
+	}
+	if p == nil {
+		return Errorf(PermissionDenied, "rpc r: permission denied for %s", serviceMethod)
+	}
+	return Errorf(PermissionDenied, "rpc r: %s is not allowed to call %s", p.Name, serviceMethod)
+}
@@ -0,0 +1,92 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Whoami replies with the name of the authenticated caller
+func (b Baz) Whoami(ctx context.Context, argv int, reply *string) error {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return errors.New("no principal")
+	}
+	*reply = p.Name + "/" + p.AuthType
+	return nil
+}
+
+func startAuthServer(t *testing.T, authn Authenticator) string {
+	server := NewServer(WithAuthenticator(authn), WithAuthorizer(ACL{
+		"Baz.Whoami": {"*"},
+		"Baz.*":      {"admin"},
+	}))
+	_assert(server.Register(Baz{}) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr().String()
+}
+
+func TestAuth_token(t *testing.T) {
+	t.Parallel()
+	addr := startAuthServer(t, TokenAuthenticator(map[string]string{"t1": "alice", "t2": "admin"}))
+
+	client, err := Dial("tcp", addr, &Option{Credentials: Metadata{"token": "t1"}})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	_assert(err == nil && reply == "alice/token", "expect alice, got %q %v", reply, err)
+	var n int
+	err = client.Call(context.Background(), "Baz.Echo", 1, &n)
+	_assert(CodeOf(err) == PermissionDenied, "expect PermissionDenied, got %v", err)
+	//请求metadata中的token优先于连接级的凭证
+	ctx := NewOutgoingContext(context.Background(), Metadata{"token": "t2"})
+	err = client.Call(ctx, "Baz.Echo", 1, &n)
+	_assert(err == nil && n == 1, "expect admin to call Echo, got %v", err)
+
+	anonymous, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = anonymous.Close() }()
+	err = anonymous.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	var se *StatusError
+	_assert(errors.As(err, &se) && se.Code == Unauthenticated, "expect Unauthenticated, got %v", err)
+}
+
+func TestAuth_hmac(t *testing.T) {
+	t.Parallel()
+	secret := []byte("secret")
+	addr := startAuthServer(t, HMACAuthenticator(map[string][]byte{"admin": secret}, time.Minute))
+
+	client, err := Dial("tcp", addr, &Option{CallCredentials: HMACCredentials("admin", secret)})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	_assert(err == nil && reply == "admin/hmac", "expect admin, got %q %v", reply, err)
+
+	forged, err := Dial("tcp", addr, &Option{CallCredentials: HMACCredentials("admin", []byte("guess"))})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = forged.Close() }()
+	err = forged.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+
+	//截获的签名只能使用一次，也不能用于别的方法
+	captured, err := HMACCredentials("admin", secret)(context.Background(), "Baz.Whoami")
+	_assert(err == nil, "sign: %v", err)
+	replay, err := Dial("tcp", addr, &Option{CallCredentials: func(context.Context, string) (Metadata, error) {
+		return captured, nil
+	}})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = replay.Close() }()
+	var n int
+	err = replay.Call(context.Background(), "Baz.Echo", 1, &n)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated for another method, got %v", err)
+	err = replay.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	_assert(err == nil && reply == "admin/hmac", "expect admin, got %q %v", reply, err)
+	err = replay.Call(context.Background(), "Baz.Whoami", 1, &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect a replayed signature to be rejected, got %v", err)
+}
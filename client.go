@@ -23,30 +23,41 @@ type Call struct {
 	Reply         interface{} // reply from the function
 	Error         error       // if error occurs, it will be set
 	Done          chan *Call  // Strobes when call is complete.
+	Trailer       Metadata    // trailer set by the service method
+	ctx           context.Context
 }
 
 // Client 客户端的的结构体
 type Client struct {
-	cc       codec.Codec //编解码器
-	opt      *Option
-	sending  sync.Mutex // protect following
-	header   codec.Header
-	mu       sync.Mutex // protect following
-	seq      uint64
-	pending  map[uint64]*Call
-	closing  bool // user has called Close
-	shutdown bool // r has told us to stop
+	cc        codec.Codec //编解码器
+	opt       *Option
+	addr      string            // 服务端地址
+	intercept ClientInterceptor // opt.Interceptors合并后的结果，没有拦截器时为nil
+	sending   sync.Mutex        // protect following
+	header    codec.Header
+	mu        sync.Mutex // protect following
+	seq       uint64
+	pending   map[uint64]*Call
+	streams   map[uint64]*ClientStream
+	closing   bool // user has called Close
+	shutdown  bool // r has told us to stop
+	draining  bool // 服务端即将关闭，不能再发起新的调用
 }
 
 //显示声明，确保client实现了连接的关闭
 var _ io.Closer = (*Client)(nil)
 
-var ErrShutdown = errors.New("connection is shut down")
-
 func (call *Call) done() {
 	call.Done <- call
 }
 
+// setTrailer 记录服务端返回的trailer，并写入用户通过WithTrailer提供的md中
+//只有还在pending中的call会走到这里，已经被放弃的call不会再写入
+func (call *Call) setTrailer(md map[string]string) {
+	call.Trailer = md
+	MergeTrailer(call.ctx, md)
+}
+
 // Dial 发起连接，network, address是服务端地址
 // 当拿到连接后，便可以在连接上构建客户端
 
@@ -69,7 +80,7 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	//DialTimeout处理
 	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
 	if err != nil {
-		return nil, err
+		return nil, notSent(ErrConnectFailed, err)
 	}
 	// close the connection if client is nil
 	defer func() {
@@ -77,26 +88,43 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 			_ = conn.Close()
 		}
 	}()
+	//TLS握手也计入连接超时
+	connect := func() (*Client, error) {
+		if opt.TLSConfig == nil {
+			return f(conn, opt)
+		}
+		tlsConn, err := tlsClient(conn, address, opt.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return f(tlsConn, opt)
+	}
 	ch := make(chan NewClientResult)
 	if opt.ConnectTimeout == 0 {
-		return NewClient(conn, opt)
+		if client, err = connect(); err != nil {
+			err = notSent(ErrConnectFailed, err)
+		}
+		return client, err
 	}
 	go func() {
 		//这里开启了一个goroutine,在最后写进了ch中，如果超时了
 		//res := <-ch:就不会被执行了，也就是携程会一直阻塞
-		client, err := f(conn, opt)
+		client, err := connect()
 		ch <- NewClientResult{client: client, err: err}
 	}()
 	idleDelay := time.NewTimer(opt.ConnectTimeout)
 	defer idleDelay.Stop()
 	select {
 	case res := <-ch:
-		return res.client, res.err
+		if res.err != nil {
+			return nil, notSent(ErrConnectFailed, res.err)
+		}
+		return res.client, nil
 	case <-idleDelay.C:
 		go func() {
 			<-ch
 		}()
-		return nil, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout)
+		return nil, notSent(ErrConnectTimeout, fmt.Errorf("rpc client: connect timeout: expect within %s", opt.ConnectTimeout))
 	}
 
 	return nil, err
@@ -123,9 +151,8 @@ func parseOptions(opts ...*Option) (*Option, error) {
 
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 	//根据option中的CodecType选择合适的序列化工具构建编解码器
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
+	cc, err := newCodec(conn, opt, opt.MaxBodySize)
+	if err != nil {
 		log.Println("rpc client: codec error:", err)
 		return nil, err
 	}
@@ -134,11 +161,33 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 		log.Println("rpc client: options error: ", err)
 		return nil, err
 	}
+	//要求压缩时等待服务端的协商结果，服务端不支持该算法时不压缩
+	if opt.Compression != codec.NoCompression {
+		reply, err := readHandshakeReply(conn)
+		if err != nil {
+			return nil, fmt.Errorf("rpc client: read handshake reply: %w", err)
+		}
+		if reply.Error != "" {
+			return nil, fmt.Errorf("rpc client: server rejected the handshake: %s", reply.Error)
+		}
+		if reply.Compression != opt.Compression {
+			o := *opt
+			o.Compression = reply.Compression
+			o.Framed = true
+			opt = &o
+			if cc, err = newCodec(conn, opt, opt.MaxBodySize); err != nil {
+				return nil, err
+			}
+		}
+	}
 	client := &Client{
-		seq:     1, // seq starts with 1, 0 means invalid call
-		cc:      f(conn),
-		opt:     opt,
-		pending: make(map[uint64]*Call),
+		seq:       1, // seq starts with 1, 0 means invalid call
+		cc:        cc,
+		opt:       opt,
+		addr:      conn.RemoteAddr().String(),
+		intercept: chainClientInterceptors(opt.Interceptors),
+		pending:   make(map[uint64]*Call),
+		streams:   make(map[uint64]*ClientStream),
 	}
 	//客户端在创建立即接受服务端的消息，避免消息的丢失
 	go client.receive()
@@ -160,36 +209,72 @@ func (client *Client) send(call *Call) {
 		return
 	}
 
-	//prepare request header
-	client.header.ServiceMethod = call.ServiceMethod
-	client.header.Seq = seq
-	client.header.Error = ""
-
-	//header := new(codec.Header)
-	//header.ServiceMethod = call.ServiceMethod
-	//header.Seq = seq
-	//header.Error = ""
-
 	// encode and send the request
 	//将请求发出
-	if err := client.cc.Encode(&client.header, call.Args); err != nil {
+	if err := client.writeRequest(call.ctx, seq, call.ServiceMethod, call.Args); err != nil {
 		//因为事先标记了call为正在处理
 		//此时没办法发出的话，要修改call的状态
 		call := client.removeCall(seq)
 		// 删除的时候如果为空,则代表call在其他处被处理了
 		// 如果不为空，记录错误信息
 		if call != nil {
-			call.Error = err
+			call.Error = sendError(err)
 			call.done()
 		}
 	}
 }
 
+// writeRequest 准备请求头并把请求写进连接，调用者需要持有sending锁
+func (client *Client) writeRequest(ctx context.Context, seq uint64, serviceMethod string, args interface{}) error {
+	//prepare request header
+	client.header.ServiceMethod = serviceMethod
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Code = 0
+	client.header.Timeout = 0
+	client.header.Metadata, _ = FromOutgoingContext(ctx)
+	if client.opt.CallCredentials != nil {
+		creds, err := client.opt.CallCredentials(ctx, serviceMethod)
+		if err != nil {
+			return fmt.Errorf("rpc client: call credentials: %w", err)
+		}
+		md := Metadata(client.header.Metadata).Copy()
+		if md == nil {
+			md = Metadata{}
+		}
+		for k, v := range creds {
+			md[k] = v
+		}
+		client.header.Metadata = md
+	}
+	//把ctx剩余的时间告诉服务端，服务端会据此设置处理请求的超时时间
+	if deadline, ok := ctx.Deadline(); ok {
+		client.header.Timeout = time.Until(deadline)
+		if client.header.Timeout <= 0 {
+			client.header.Timeout = time.Nanosecond // 已经超时，0表示不限制
+		}
+	}
+	return client.cc.Encode(&client.header, args)
+}
+
+// sendCancel 发送一条取消消息，服务端收到后会取消seq对应请求的ctx
+func (client *Client) sendCancel(seq uint64) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	h := &codec.Header{Seq: seq, Kind: codec.KindCancel}
+	if err := client.cc.Encode(h, invalidRequest); err != nil {
+		log.Println("rpc client: send cancel error:", err)
+	}
+}
+
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	if client.closing || client.shutdown {
-		return 0, ErrShutdown
+		return 0, notSent(ErrShutdown, ErrShutdown)
+	}
+	if client.draining {
+		return 0, notSent(ErrDraining, ErrDraining)
 	}
 	call.Seq = client.seq
 	client.pending[call.Seq] = call
@@ -202,7 +287,29 @@ func (client *Client) receive() {
 	for err == nil {
 		var h codec.Header
 		if err = client.cc.ReadHeader(&h); err != nil {
-			break
+			if !errors.As(err, new(*codec.HeaderError)) {
+				break
+			}
+			//应答已被跳过，连接仍然可用；部分解码出的Seq对应一个调用时让它失败，否则它只能等到ctx结束
+			if call := client.removeCall(h.Seq); call != nil {
+				call.Error = &CallError{Class: ErrCodec, Sent: true, Err: err}
+				call.done()
+			}
+			err = nil
+			continue
+		}
+		//服务端通知即将关闭，已经发出的调用仍会收到应答
+		if h.Kind == codec.KindGoAway {
+			client.mu.Lock()
+			client.draining = true
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		//属于流的消息交给对应的ClientStream处理
+		if stream := client.getStream(h.Seq); stream != nil {
+			err = stream.receive(&h)
+			continue
 		}
 		call := client.removeCall(h.Seq)
 		switch {
@@ -211,13 +318,19 @@ func (client *Client) receive() {
 			// and call was already removed.
 			err = client.cc.ReadBody(nil)
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = headerError(&h)
+			call.setTrailer(h.Metadata)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
+			call.setTrailer(h.Metadata)
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
+				call.Error = &CallError{Class: ErrCodec, Sent: true, Err: errors.New("reading body " + err.Error())}
+				//消息体已被完整读出，连接仍然可用
+				if errors.As(err, new(*codec.BodyError)) {
+					err = nil
+				}
 			}
 			call.done()
 		}
@@ -242,10 +355,20 @@ func (client *Client) terminateCalls(err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	client.shutdown = true
+	//已经发出的调用不知道服务端是否执行了
+	class := ErrConnectionLost
+	if client.closing {
+		class = ErrShutdown
+	}
+	err = &CallError{Class: class, Sent: true, Err: err}
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
 	}
+	for seq, stream := range client.streams {
+		delete(client.streams, seq)
+		stream.finish(err, nil)
+	}
 }
 
 //显示声明，确保client实现了连接的关闭
@@ -267,8 +390,16 @@ func (client *Client) Close() error {
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	//closing和shutdown只要有一个为真，client便是不可用状态
-	return !client.shutdown && !client.closing
+	//closing、shutdown和draining只要有一个为真，client便是不可用状态
+	return !client.shutdown && !client.closing && !client.draining
+}
+
+// IsDraining 判断服务端是否通知了即将关闭，但连接上还有调用没有完成
+// 这时不能发起新的调用，也不应该关闭client，连接会在调用完成后由服务端关闭
+func (client *Client) IsDraining() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.draining && !client.shutdown && !client.closing
 }
 
 //Go 和 Call 是客户端暴露给用户的两个 RPC 服务调用接口，Go 是一个异步接口，返回 call 实例。
@@ -279,11 +410,37 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 	} else if cap(done) == 0 {
 		log.Panic("rpc client: done channel is unbuffered")
 	}
+	if client.intercept == nil {
+		return client.goCtx(context.Background(), serviceMethod, args, reply, done)
+	}
+	//有拦截器时，在新的goroutine中执行整个拦截器链，结束后再通知done
 	call := &Call{
 		ServiceMethod: serviceMethod,
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		ctx:           context.Background(),
+	}
+	go func() {
+		info := &CallInfo{ServiceMethod: serviceMethod, Addr: client.addr}
+		call.Error = client.intercept(call.ctx, info, args, reply, func(ctx context.Context, args, reply interface{}) error {
+			c := <-client.goCtx(ctx, serviceMethod, args, reply, make(chan *Call, 1)).Done
+			call.Seq, call.Trailer = c.Seq, c.Trailer
+			return c.Error
+		})
+		call.done()
+	}()
+	return call
+}
+
+// goCtx 与Go相同，但不经过拦截器，ctx的截止时间会随请求一起发给服务端
+func (client *Client) goCtx(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          done,
+		ctx:           ctx,
 	}
 	client.send(call)
 	return call
@@ -292,13 +449,28 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if client.intercept == nil {
+		return client.invoke(ctx, serviceMethod, args, reply)
+	}
+	info := &CallInfo{ServiceMethod: serviceMethod, Addr: client.addr}
+	return client.intercept(ctx, info, args, reply, func(ctx context.Context, args, reply interface{}) error {
+		return client.invoke(ctx, serviceMethod, args, reply)
+	})
+}
 
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+// invoke 发送请求并等待应答，不经过拦截器
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	call := client.goCtx(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		//call仍在pending中，说明服务端还在处理，通知服务端放弃它
+		if client.removeCall(call.Seq) == nil {
+			//应答已经到达，以应答为准
+			return (<-call.Done).Error
+		}
+		client.sendCancel(call.Seq)
+		return &CallError{Class: ctx.Err(), Sent: true, Err: fmt.Errorf("rpc client: call failed: %w", ctx.Err())}
 	case call := <-call.Done:
 		return call.Error
 	}
@@ -2,10 +2,12 @@ package tinyrpc
 
 import (
 	"context"
+	"errors"
 	"net"
 	"strings"
 	"testing"
 	"time"
+	"tinyrpc/codec"
 )
 
 type Bar int
@@ -37,6 +39,7 @@ func TestClient_dialTimeout(t *testing.T) {
 	t.Run("timeout", func(t *testing.T) {
 		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: time.Second})
 		_assert(err != nil && strings.Contains(err.Error(), "connect timeout"), "expect a timeout error")
+		_assert(errors.Is(err, ErrConnectTimeout) && errors.Is(err, ErrNotSent), "expect a not sent connect timeout, got %v", err)
 	})
 	t.Run("0", func(t *testing.T) {
 		_, err := dialTimeout(f, "tcp", l.Addr().String(), &Option{ConnectTimeout: 0})
@@ -52,10 +55,12 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
+		_assert(errors.Is(err, context.DeadlineExceeded) && errors.Is(err, ErrPossiblyExecuted), "expect a possibly executed call, got %v", err)
 	})
 	t.Run("r handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &Option{
@@ -64,5 +69,36 @@ func TestClient_Call(t *testing.T) {
 		var reply int
 		err := client.Call(context.Background(), "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		_assert(CodeOf(err) == DeadlineExceeded && !errors.As(err, new(*CallError)), "expect a status error, got %v", err)
 	})
 }
+
+func TestClient_errorClasses(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+
+	//连接断开时，已经发出的调用可能被执行了
+	done := make(chan error, 1)
+	go func() { done <- client.Call(context.Background(), "Baz.Sleep", 1000, new(int)) }()
+	time.Sleep(time.Millisecond * 100)
+	_ = client.Close()
+	err = <-done
+	_assert(errors.Is(err, ErrShutdown) && errors.Is(err, ErrPossiblyExecuted), "expect a possibly executed call, got %v", err)
+	_assert(!SafeToRetry(err), "a sent call is not safe to retry")
+
+	//关闭后发起的调用确定没有发出
+	err = client.Call(context.Background(), "Baz.Echo", 1, new(int))
+	_assert(errors.Is(err, ErrShutdown) && errors.Is(err, ErrNotSent), "expect a not sent call, got %v", err)
+	_assert(SafeToRetry(err), "a call that was never sent is safe to retry")
+
+	//服务端关闭时拒绝的请求没有执行，方法自己返回的Unavailable则不能确定
+	h := &codec.Header{}
+	setError(h, errServerShutdown)
+	_assert(SafeToRetry(headerError(h)), "a request rejected by a shutting down server is safe to retry")
+	_assert(!SafeToRetry(Errorf(Unavailable, "backend down")), "an Unavailable from the method is not safe to retry")
+
+	_, err = Dial("tcp", "127.0.0.1:1")
+	_assert(errors.Is(err, ErrConnectFailed) && errors.Is(err, ErrNotSent), "expect a connect error, got %v", err)
+}
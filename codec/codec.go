@@ -1,6 +1,10 @@
 package codec
 
-import "io"
+import (
+	"io"
+	"reflect"
+	"time"
+)
 
 //序列化和反序列化是将数据结构转换为字节流或将字节流转换为数据结构的过程
 //该包负责从基于字节流的TCP连接上解析出双方想要的数据
@@ -12,8 +16,34 @@ type Header struct {
 	ServiceMethod string
 	Seq           uint64 //用于标识当前RPC请求的唯一标识符
 	Error         string //错误信息
+	Code          uint32 //错误码，0表示没有错误码，取值见tinyrpc.Code
+	Kind          Kind   //消息的类型，零值表示普通的请求或应答
+	//客户端剩余的超时时间，0表示不限制。使用相对时间，避免两端时钟不一致
+	Timeout time.Duration
+	//请求中为客户端设置的元数据，应答中为服务端方法设置的trailer
+	Metadata map[string]string
+	//错误的详情，只在应答中使用
+	Details []Detail
+}
+
+// Detail 错误详情，Data为Type类型的值的JSON编码
+type Detail struct {
+	Type string
+	Data []byte
 }
 
+// Kind 表示一条消息的类型
+type Kind uint8
+
+const (
+	KindCall      Kind = iota // 普通的请求或应答
+	KindCancel                // 客户端放弃了Seq对应的请求，服务端应取消该请求的ctx
+	KindGoAway                // 服务端即将关闭，不再接收这个连接上新的请求
+	KindStream                // 流式调用中的一条消息
+	KindStreamEnd             // 流式调用结束，Error为空表示正常结束；客户端发送时表示不会再发送消息
+	KindWindow                // 流量控制，消息体为对端归还的可发送消息数
+)
+
 // Codec Codec代表编解码器(Coder-Decoder)，是一个接口类型
 // 它定义了从连接上读写数据的方法，和关闭连接的方法
 type Codec interface {
@@ -24,6 +54,17 @@ type Codec interface {
 	Encode(*Header, interface{}) error // 功能与Write类似
 }
 
+// TypeChecker 由对消息体类型有要求的编解码器实现
+//服务端在调用方法前用它检查方法的参数和返回值类型，给出明确的错误
+type TypeChecker interface {
+	CheckType(reflect.Type) error
+}
+
+// BodyLimiter 由能够限制消息体长度的编解码器实现，超过n的消息体被跳过并返回*BodyError
+type BodyLimiter interface {
+	SetMaxBodySize(n uint32)
+}
+
 type NewCodec interface {
 	io.Closer
 	Encode(*Header, interface{}) error
@@ -40,10 +81,24 @@ type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // not implemented
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json" // not implemented
+	ProtobufType Type = "application/protobuf"
+	MsgpackType  Type = "application/msgpack"
 )
 
+// Marshaler 把单个值编码为字节，或从字节中解码
+//分帧的编解码器用它编码每一帧中的头和消息体
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// MarshalerMap 根据Type找到对应的Marshaler，用于分帧传输和压缩
+//在NewCodecFuncMap中注册新的编解码器时，需要在这里同时注册它的Marshaler，
+//否则这种编解码器只能不分帧使用，要求压缩时服务端会在握手中拒绝
+var MarshalerMap map[Type]Marshaler
+
 // NewCodecFuncMap 根据Type找到对应该编解码器类型的构造函数
 var NewCodecFuncMap map[Type]NewCodecFunc
 
@@ -51,4 +106,12 @@ func init() {
 	NewCodecFuncMap = make(map[Type]NewCodecFunc)
 	NewCodecFuncMap[GobType] = NewGobCodec
 	NewCodecFuncMap[JsonType] = NewJsonCodec
+	NewCodecFuncMap[ProtobufType] = NewProtobufCodec
+	NewCodecFuncMap[MsgpackType] = NewMsgpackCodec
+
+	MarshalerMap = make(map[Type]Marshaler)
+	MarshalerMap[GobType] = gobMarshaler{}
+	MarshalerMap[JsonType] = jsonMarshaler{}
+	MarshalerMap[ProtobufType] = protobufMarshaler{}
+	MarshalerMap[MsgpackType] = msgpackMarshaler{}
 }
@@ -0,0 +1,136 @@
+package codec
+
+//消息体压缩，只在分帧传输时可用
+//压缩算法记录在帧头的flags中，很小的消息体可以不压缩
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression 压缩算法的名称，在Option中协商
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Snappy        Compression = "snappy"
+	Zstd          Compression = "zstd"
+)
+
+// DefaultCompressMinSize 小于该长度的消息体不压缩
+const DefaultCompressMinSize = 1 << 10
+
+// Compressor 压缩和解压消息体
+type Compressor interface {
+	Compress(b []byte) ([]byte, error)
+	// Decompress 解压后的长度超过limit时返回ErrBodyTooLarge
+	Decompress(b []byte, limit uint32) ([]byte, error)
+}
+
+// 帧头flags的低两位表示消息体的压缩算法
+const flagCompressMask uint8 = 0x3
+
+var compressors = [flagCompressMask + 1]Compressor{
+	1: gzipCompressor{},
+	2: snappyCompressor{},
+	3: zstdCompressor{},
+}
+
+var compressionFlags = map[Compression]uint8{
+	Gzip:   1,
+	Snappy: 2,
+	Zstd:   3,
+}
+
+// Supported 判断是否支持压缩算法c，NoCompression总是支持
+func (c Compression) Supported() bool {
+	_, err := compressionFlag(c)
+	return err == nil
+}
+
+// compressionFlag 返回压缩算法在帧头中的标记，不支持时返回错误
+func compressionFlag(name Compression) (uint8, error) {
+	if name == NoCompression {
+		return 0, nil
+	}
+	flag, ok := compressionFlags[name]
+	if !ok {
+		return 0, fmt.Errorf("rpc codec: unsupported compression %q", name)
+	}
+	return flag, nil
+}
+
+//读取解压后的数据，最多读取limit个字节
+func readLimited(r io.Reader, limit uint32) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > int(limit) {
+		return nil, ErrBodyTooLarge
+	}
+	return b, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(b []byte, limit uint32) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return readLimited(r, limit)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCompressor) Decompress(b []byte, limit uint32) ([]byte, error) {
+	n, err := snappy.DecodedLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if n > int(limit) {
+		return nil, ErrBodyTooLarge
+	}
+	return snappy.Decode(nil, b)
+}
+
+type zstdCompressor struct{}
+
+//zstd的编码器创建代价较高，EncodeAll可以并发使用
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+func (zstdCompressor) Compress(b []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(b, nil), nil
+}
+
+func (zstdCompressor) Decompress(b []byte, limit uint32) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(b), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
@@ -0,0 +1,284 @@
+package codec
+
+//分帧传输：每条消息前有一个固定长度的帧头，记录头和消息体的长度
+//接收方不需要解码消息体就能跳过它，消息体出错也不会影响后续的消息
+//| magic(2) | version(1) | flags(1) | header length(4) | body length(4) | Header | Body |
+//flags的低两位表示消息体的压缩算法，其余位保留
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+)
+
+const (
+	FrameMagic   uint16 = 0x7472 // "tr"
+	FrameVersion uint8  = 1
+	// FrameHeaderSize 固定帧头的长度
+	FrameHeaderSize = 12
+	// MaxHeaderSize Header编码后的最大长度，超过时认为连接上的数据已经不可信
+	MaxHeaderSize = 64 << 10
+	// DefaultMaxBodySize 默认的消息体最大长度
+	DefaultMaxBodySize = 16 << 20
+)
+
+var (
+	ErrBadMagic       = errors.New("rpc codec: invalid frame magic")
+	ErrBadVersion     = errors.New("rpc codec: unsupported frame version")
+	ErrBadFlags       = errors.New("rpc codec: unsupported frame flags")
+	ErrHeaderTooLarge = errors.New("rpc codec: frame header too large")
+	ErrBodyTooLarge   = errors.New("rpc codec: frame body too large")
+)
+
+// BodyError 消息体无法解码，但已经被完整读出，连接仍然可以继续使用
+type BodyError struct {
+	Err error
+}
+
+func (e *BodyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderError 消息头无法解码，这一帧的消息体已经被跳过，连接仍然可以继续使用
+//传给ReadHeader的Header中可能有部分解码出的字段
+type HeaderError struct {
+	Err error
+}
+
+func (e *HeaderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// FrameHeader 固定长度的帧头，代理可以只解析它和Header来转发消息
+type FrameHeader struct {
+	Version   uint8
+	Flags     uint8
+	HeaderLen uint32
+	BodyLen   uint32
+}
+
+// ReadFrameHeader 从r中读取并检查一个帧头
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	var b [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return FrameHeader{}, err
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != FrameMagic {
+		return FrameHeader{}, ErrBadMagic
+	}
+	fh := FrameHeader{
+		Version:   b[2],
+		Flags:     b[3],
+		HeaderLen: binary.BigEndian.Uint32(b[4:8]),
+		BodyLen:   binary.BigEndian.Uint32(b[8:12]),
+	}
+	if fh.Version != FrameVersion {
+		return fh, ErrBadVersion
+	}
+	if fh.Flags&^flagCompressMask != 0 {
+		return fh, ErrBadFlags
+	}
+	if fh.HeaderLen > MaxHeaderSize {
+		return fh, ErrHeaderTooLarge
+	}
+	return fh, nil
+}
+
+// Bytes 返回帧头编码后的字节
+func (fh FrameHeader) Bytes() []byte {
+	b := make([]byte, FrameHeaderSize)
+	binary.BigEndian.PutUint16(b[0:2], FrameMagic)
+	b[2] = fh.Version
+	b[3] = fh.Flags
+	binary.BigEndian.PutUint32(b[4:8], fh.HeaderLen)
+	binary.BigEndian.PutUint32(b[8:12], fh.BodyLen)
+	return b
+}
+
+// FramedCodec 在任意Marshaler之上按帧读写消息
+type FramedCodec struct {
+	//解码器读写的对象，一个连接
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	//写缓冲区
+	buf         *bufio.Writer
+	m           Marshaler
+	maxBodySize uint32
+	bodyLen     uint32 // 当前帧还没有读取的消息体长度
+	bodyFlags   uint8  // 当前帧的flags
+	//发送时使用的压缩算法，只压缩不小于compressMin的消息体
+	compress    uint8
+	compressMin int
+}
+
+var _ Codec = (*FramedCodec)(nil)
+
+// SetCompression 设置发送消息体时使用的压缩算法，minSize为0时使用DefaultCompressMinSize
+//接收时根据帧头的flags解压，与这里的设置无关
+func (c *FramedCodec) SetCompression(name Compression, minSize int) error {
+	flag, err := compressionFlag(name)
+	if err != nil {
+		return err
+	}
+	if minSize == 0 {
+		minSize = DefaultCompressMinSize
+	}
+	c.compress, c.compressMin = flag, minSize
+	return nil
+}
+
+// NewFramedCodec maxBodySize为0时使用DefaultMaxBodySize
+func NewFramedCodec(conn io.ReadWriteCloser, m Marshaler, maxBodySize uint32) *FramedCodec {
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	return &FramedCodec{
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		buf:         bufio.NewWriter(conn),
+		m:           m,
+		maxBodySize: maxBodySize,
+	}
+}
+
+// ReadHeader 读取下一帧的头，头无法解码时跳过这一帧并返回*HeaderError
+func (c *FramedCodec) ReadHeader(h *Header) error {
+	//上一帧的消息体没有被读取时先跳过它
+	if err := c.discardBody(); err != nil {
+		return err
+	}
+	fh, err := ReadFrameHeader(c.r)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, fh.HeaderLen)
+	if _, err = io.ReadFull(c.r, b); err != nil {
+		return unexpectedEOF(err)
+	}
+	c.bodyLen, c.bodyFlags = fh.BodyLen, fh.Flags
+	*h = Header{}
+	if err = c.m.Unmarshal(b, h); err != nil {
+		if derr := c.discardBody(); derr != nil {
+			return derr
+		}
+		return &HeaderError{Err: fmt.Errorf("rpc codec: decode header: %w", err)}
+	}
+	return nil
+}
+
+// ReadBody 读取当前帧的消息体，body为nil时跳过
+//消息体过大或者无法解码时返回*BodyError
+func (c *FramedCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return c.discardBody()
+	}
+	if c.bodyLen > c.maxBodySize {
+		n := c.bodyLen
+		if err := c.discardBody(); err != nil {
+			return err
+		}
+		return &BodyError{Err: fmt.Errorf("%w: %d > %d", ErrBodyTooLarge, n, c.maxBodySize)}
+	}
+	b := make([]byte, c.bodyLen)
+	c.bodyLen = 0
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return unexpectedEOF(err)
+	}
+	if flag := c.bodyFlags & flagCompressMask; flag != 0 {
+		var err error
+		if b, err = compressors[flag].Decompress(b, c.maxBodySize); err != nil {
+			return &BodyError{Err: fmt.Errorf("rpc codec: decompress body: %w", err)}
+		}
+	}
+	if err := c.m.Unmarshal(b, body); err != nil {
+		return &BodyError{Err: err}
+	}
+	return nil
+}
+
+func (c *FramedCodec) discardBody() error {
+	n := c.bodyLen
+	c.bodyLen = 0
+	if _, err := c.r.Discard(int(n)); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+func (c *FramedCodec) Write(h *Header, body interface{}) error {
+	return c.Encode(h, body)
+}
+
+func (c *FramedCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *FramedCodec) Decode(h *Header, body interface{}) error {
+	if err := c.ReadHeader(h); err != nil {
+		return err
+	}
+	return c.ReadBody(body)
+}
+
+// Encode 写入一帧，头或消息体无法编码时不写入任何内容，连接仍然可用
+func (c *FramedCodec) Encode(h *Header, body interface{}) (err error) {
+	hb, err := c.m.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if len(hb) > MaxHeaderSize {
+		return ErrHeaderTooLarge
+	}
+	bb, err := c.m.Marshal(body)
+	if err != nil {
+		return err
+	}
+	fh := FrameHeader{Version: FrameVersion}
+	//压缩后没有变小时直接发送原始数据
+	if c.compress != 0 && len(bb) >= c.compressMin {
+		if cb, cerr := compressors[c.compress].Compress(bb); cerr == nil && len(cb) < len(bb) {
+			bb, fh.Flags = cb, c.compress
+		}
+	}
+	fh.HeaderLen, fh.BodyLen = uint32(len(hb)), uint32(len(bb))
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	for _, b := range [][]byte{fh.Bytes(), hb, bb} {
+		if _, err = c.buf.Write(b); err != nil {
+			log.Println("rpc: error writing frame:", err)
+			return
+		}
+	}
+	return
+}
+
+// CheckType 对消息体类型有要求的Marshaler可以实现TypeChecker
+func (c *FramedCodec) CheckType(t reflect.Type) error {
+	if tc, ok := c.m.(TypeChecker); ok {
+		return tc.CheckType(t)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
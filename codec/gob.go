@@ -4,6 +4,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -86,3 +87,16 @@ func (c *GobCodec) Encode(h *Header, body interface{}) (err error) {
 	}
 	return
 }
+
+//分帧时每条消息单独编码，接收方可以跳过任意一帧，代价是每帧都带有类型信息
+type gobMarshaler struct{}
+
+func (gobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobMarshaler) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
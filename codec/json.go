@@ -39,6 +39,11 @@ func (c *JsonCodec) ReadHeader(h *Header) error {
 }
 
 func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		//body为nil时只需跳过这条消息体
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
 	return c.dec.Decode(body)
 }
 
@@ -86,3 +91,13 @@ func (c *JsonCodec) Encode(h *Header, body interface{}) (err error) {
 	}
 	return
 }
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaler) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,100 @@
+package codec
+
+//MessagePack是一种紧凑的二进制序列化格式，多种语言都有实现
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgpackCodec 定义了一种MessagePack类型的编解码器
+//结构体字段使用msgpack标签，没有msgpack标签时使用json标签
+type MsgpackCodec struct {
+	//解码器读写的对象，一个连接
+	conn io.ReadWriteCloser
+	//写缓冲区
+	buf *bufio.Writer
+	dec *msgpack.Decoder
+	enc *msgpack.Encoder
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	dec := msgpack.NewDecoder(bufio.NewReader(conn))
+	dec.SetCustomStructTag("json")
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  dec,
+		enc:  enc,
+	}
+}
+
+func (c *MsgpackCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+func (c *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		//body为nil时只需跳过这条消息体
+		return c.dec.Skip()
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec) Write(h *Header, body interface{}) error {
+	return c.Encode(h, body)
+}
+
+func (c *MsgpackCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *MsgpackCodec) Decode(h *Header, body interface{}) error {
+	if err := c.ReadHeader(h); err != nil {
+		return err
+	}
+	return c.ReadBody(body)
+}
+
+func (c *MsgpackCodec) Encode(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.enc.Encode(h); err != nil {
+		log.Println("rpc: msgpack error encoding header:", err)
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		log.Println("rpc: msgpack error encoding body:", err)
+		return
+	}
+	return
+}
+
+type msgpackMarshaler struct{}
+
+func (msgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (msgpackMarshaler) Unmarshal(b []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,436 @@
+package codec
+
+//protobuf编解码器，消息体必须实现proto.Message，便于和使用protobuf的其他语言共享消息定义
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+//每条消息由两个带长度前缀(varint)的帧组成：头和消息体
+//头按下面的protobuf定义编码，其他语言可以据此解析：
+//
+//	message Header {
+//	  string service_method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  uint32 kind = 4;
+//	  int64 timeout = 5; // 纳秒
+//	  map<string, string> metadata = 6;
+//	  uint32 code = 7;
+//	  repeated Detail details = 8; // message Detail { string type = 1; bytes data = 2; }
+//	}
+//
+//消息体为空帧时表示没有消息体，例如出错时的应答
+//头的长度不能超过MaxHeaderSize，消息体的长度不能超过SetMaxBodySize设置的值，检查在分配内存之前进行
+const (
+	headerServiceMethod protowire.Number = iota + 1
+	headerSeq
+	headerError
+	headerKind
+	headerTimeout
+	headerMetadata
+	headerCode
+	headerDetails
+)
+
+var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// ProtobufCodec 定义了一种protobuf类型的编解码器
+type ProtobufCodec struct {
+	//解码器读写的对象，一个连接
+	conn io.ReadWriteCloser
+	//读写缓冲区
+	r           *bufio.Reader
+	buf         *bufio.Writer
+	maxBodySize uint32
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+var _ BodyLimiter = (*ProtobufCodec)(nil)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		buf:         bufio.NewWriter(conn),
+		maxBodySize: DefaultMaxBodySize,
+	}
+}
+
+// SetMaxBodySize 设置允许读取的最大消息体，n为0时使用DefaultMaxBodySize
+func (c *ProtobufCodec) SetMaxBodySize(n uint32) {
+	if n == 0 {
+		n = DefaultMaxBodySize
+	}
+	c.maxBodySize = n
+}
+
+// ReadHeader 读取一帧头，头过长时连接上的数据已经不可信，返回ErrHeaderTooLarge
+func (c *ProtobufCodec) ReadHeader(h *Header) error {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if n > MaxHeaderSize {
+		return ErrHeaderTooLarge
+	}
+	b, err := c.readFrame(n)
+	if err != nil {
+		return err
+	}
+	return unmarshalHeader(b, h)
+}
+
+// ReadBody 读取一帧消息体，body为nil时跳过
+//即使body的类型不对或者消息体过大也会读完整帧，连接上后续的消息不受影响
+func (c *ProtobufCodec) ReadBody(body interface{}) error {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if body == nil || n > uint64(c.maxBodySize) {
+		if err = c.discard(n); err != nil || body == nil {
+			return err
+		}
+		return &BodyError{Err: fmt.Errorf("%w: %d > %d", ErrBodyTooLarge, n, c.maxBodySize)}
+	}
+	b, err := c.readFrame(n)
+	if err != nil {
+		return err
+	}
+	if err = unmarshalBody(b, body); err != nil {
+		return &BodyError{Err: err}
+	}
+	return nil
+}
+
+func unmarshalBody(b []byte, body interface{}) (err error) {
+	if m, ok := body.(proto.Message); ok {
+		return proto.Unmarshal(b, m)
+	}
+	//框架内部的控制消息使用基本类型，借助wrapperspb编码
+	switch v := body.(type) {
+	case *uint32:
+		w := new(wrapperspb.UInt32Value)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *uint64:
+		w := new(wrapperspb.UInt64Value)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *int32:
+		w := new(wrapperspb.Int32Value)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *int64:
+		w := new(wrapperspb.Int64Value)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *string:
+		w := new(wrapperspb.StringValue)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *bool:
+		w := new(wrapperspb.BoolValue)
+		err = proto.Unmarshal(b, w)
+		*v = w.Value
+	case *struct{}:
+	default:
+		return fmt.Errorf("rpc codec: protobuf: %T is not a proto.Message", body)
+	}
+	return err
+}
+
+func (c *ProtobufCodec) Write(h *Header, body interface{}) error {
+	return c.Encode(h, body)
+}
+
+func (c *ProtobufCodec) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ProtobufCodec) Decode(h *Header, body interface{}) error {
+	if err := c.ReadHeader(h); err != nil {
+		return err
+	}
+	return c.ReadBody(body)
+}
+
+// Encode 写入头和消息体
+//消息体不是proto.Message时不写入任何内容并返回错误，连接仍然可用
+func (c *ProtobufCodec) Encode(h *Header, body interface{}) error {
+	b, err := marshalBody(body)
+	if err != nil {
+		return err
+	}
+	return c.write(h, b)
+}
+
+// CheckType 检查t或*t是否实现了proto.Message
+func (c *ProtobufCodec) CheckType(t reflect.Type) error {
+	if t.Implements(typeOfProtoMessage) || reflect.PtrTo(t).Implements(typeOfProtoMessage) {
+		return nil
+	}
+	return fmt.Errorf("rpc codec: protobuf: %s is not a proto.Message", t)
+}
+
+func (c *ProtobufCodec) write(h *Header, body []byte) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+	if err = c.writeFrame(marshalHeader(h)); err != nil {
+		log.Println("rpc: protobuf error encoding header:", err)
+		return
+	}
+	if err = c.writeFrame(body); err != nil {
+		log.Println("rpc: protobuf error encoding body:", err)
+		return
+	}
+	return
+}
+
+// readFrame 读取长度为n的一帧，调用者需要先检查n
+func (c *ProtobufCodec) readFrame(n uint64) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// discard 跳过长度为n的一帧
+func (c *ProtobufCodec) discard(n uint64) error {
+	if n > math.MaxInt64 {
+		return ErrBodyTooLarge
+	}
+	if _, err := io.CopyN(io.Discard, c.r, int64(n)); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+func (c *ProtobufCodec) writeFrame(b []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	if _, err := c.buf.Write(size[:binary.PutUvarint(size[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	_, err := c.buf.Write(b)
+	return err
+}
+
+func marshalBody(body interface{}) ([]byte, error) {
+	var m proto.Message
+	switch v := body.(type) {
+	case nil, struct{}, *struct{}:
+		return nil, nil
+	case proto.Message:
+		m = v
+	case uint32:
+		m = wrapperspb.UInt32(v)
+	case uint64:
+		m = wrapperspb.UInt64(v)
+	case int32:
+		m = wrapperspb.Int32(v)
+	case int64:
+		m = wrapperspb.Int64(v)
+	case string:
+		m = wrapperspb.String(v)
+	case bool:
+		m = wrapperspb.Bool(v)
+	default:
+		return nil, fmt.Errorf("rpc codec: protobuf: %T is not a proto.Message", body)
+	}
+	return proto.Marshal(m)
+}
+
+func marshalHeader(h *Header) []byte {
+	var b []byte
+	if h.ServiceMethod != "" {
+		b = protowire.AppendTag(b, headerServiceMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.ServiceMethod)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, headerSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, headerError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Kind != KindCall {
+		b = protowire.AppendTag(b, headerKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, headerTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, headerCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	for _, d := range h.Details {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, d.Type)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, d.Data)
+		b = protowire.AppendTag(b, headerDetails, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	//map按重复的键值对消息编码
+	for k, v := range h.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, headerMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == headerServiceMethod && typ == protowire.BytesType:
+			h.ServiceMethod, n = protowire.ConsumeString(b)
+		case num == headerSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == headerError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == headerKind && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Kind = Kind(v)
+		case num == headerTimeout && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Timeout = time.Duration(v)
+		case num == headerCode && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(v)
+		case num == headerMetadata && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := unmarshalMetadataEntry(entry, h); err != nil {
+					return err
+				}
+			}
+		case num == headerDetails && typ == protowire.BytesType:
+			var entry []byte
+			entry, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				if err := unmarshalDetail(entry, h); err != nil {
+					return err
+				}
+			}
+		default:
+			//跳过不认识的字段，便于以后扩展头
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalMetadataEntry(b []byte, h *Header) error {
+	var k, v string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			k, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			v, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if h.Metadata == nil {
+		h.Metadata = make(map[string]string)
+	}
+	h.Metadata[k] = v
+	return nil
+}
+
+type protobufMarshaler struct{}
+
+func (protobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if h, ok := v.(*Header); ok {
+		return marshalHeader(h), nil
+	}
+	return marshalBody(v)
+}
+
+func (protobufMarshaler) Unmarshal(b []byte, v interface{}) error {
+	if h, ok := v.(*Header); ok {
+		return unmarshalHeader(b, h)
+	}
+	return unmarshalBody(b, v)
+}
+
+func (protobufMarshaler) CheckType(t reflect.Type) error {
+	return (*ProtobufCodec)(nil).CheckType(t)
+}
+
+func unmarshalDetail(b []byte, h *Header) error {
+	var d Detail
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			d.Type, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			var data []byte
+			data, n = protowire.ConsumeBytes(b)
+			d.Data = append([]byte(nil), data...)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	h.Details = append(h.Details, d)
+	return nil
+}
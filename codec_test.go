@@ -0,0 +1,248 @@
+package tinyrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tinyrpc/codec"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Upper replies with the upper-cased argument and the incoming "suffix" metadata
+func (b Baz) Upper(ctx context.Context, argv *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	md, _ := FromIncomingContext(ctx)
+	reply.Value = strings.ToUpper(argv.Value) + md["suffix"]
+	return SetTrailer(ctx, Metadata{"served-by": "baz"})
+}
+
+func TestProtobufCodec(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	trailer := Metadata{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = WithTrailer(NewOutgoingContext(ctx, Metadata{"suffix": "!"}), trailer)
+	reply := new(wrapperspb.StringValue)
+	err = client.Call(ctx, "Baz.Upper", wrapperspb.String("tiny"), reply)
+	_assert(err == nil && reply.Value == "TINY!", "expect TINY!, got %q %v", reply.Value, err)
+	_assert(trailer["served-by"] == "baz", "expect trailer, got %v", trailer)
+
+	//参数不是proto.Message时返回明确的错误，连接仍然可用
+	var n int
+	err = client.Call(ctx, "Baz.Echo", wrapperspb.Int64(1), &n)
+	_assert(err != nil && strings.Contains(err.Error(), "not a proto.Message"), "expect a type error, got %v", err)
+	err = client.Call(ctx, "Baz.Echo", 1, &n)
+	_assert(err != nil && strings.Contains(err.Error(), "not a proto.Message"), "expect a type error, got %v", err)
+	err = client.Call(ctx, "Baz.Upper", wrapperspb.String("again"), reply)
+	_assert(err == nil && reply.Value == "AGAIN!", "expect AGAIN!, got %q %v", reply.Value, err)
+}
+
+func TestProtobufCodec_limits(t *testing.T) {
+	t.Parallel()
+	_, addr, _ := newBazServer(t, WithMaxBodySize(64))
+
+	//超出范围的长度前缀只关闭这个连接，不会让服务端崩溃
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_assert(json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.ProtobufType}) == nil, "send option")
+	var size [binary.MaxVarintLen64]byte
+	_, err = conn.Write(size[:binary.PutUvarint(size[:], 1<<62)])
+	_assert(err == nil, "send length: %v", err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	_assert(err == io.EOF, "expect the server to close the connection, got %v", err)
+
+	//过大的消息体被跳过，连接仍然可用
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	reply := new(wrapperspb.StringValue)
+	err = client.Call(context.Background(), "Baz.Upper", wrapperspb.String(strings.Repeat("x", 100)), reply)
+	_assert(err != nil && strings.Contains(err.Error(), "too large"), "expect body too large, got %v", err)
+	err = client.Call(context.Background(), "Baz.Upper", wrapperspb.String("tiny"), reply)
+	_assert(err == nil && reply.Value == "TINY", "expect TINY, got %q %v", reply.Value, err)
+}
+
+type Tagged struct {
+	Name  string                 `msgpack:"name"`
+	Extra map[string]interface{} `json:"extra"`
+}
+
+// Types describes the dynamic types found in argv.Extra
+func (b Baz) Types(argv Tagged, reply *string) error {
+	*reply = fmt.Sprintf("%s %T", argv.Name, argv.Extra["n"])
+	return nil
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.MsgpackType})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	args := Tagged{Name: "baz", Extra: map[string]interface{}{"n": int64(1) << 60}}
+	err = client.Call(context.Background(), "Baz.Types", args, &reply)
+	_assert(err == nil && reply == "baz int64", "expect integer type kept, got %q %v", reply, err)
+	err = client.Call(context.Background(), "Baz.Unknown", args, &reply)
+	_assert(err != nil, "expect an error for unknown method")
+	err = client.Call(context.Background(), "Baz.Echo", 2, new(int))
+	_assert(err == nil, "connection should still be usable: %v", err)
+}
+
+func TestFramedCodec(t *testing.T) {
+	t.Parallel()
+	b := Baz{canceled: make(chan error, 1)}
+	server := NewServer(WithMaxBodySize(64))
+	_assert(server.Register(b) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: typ, Framed: true, MaxBodySize: 1 << 10})
+			_assert(err == nil, "dial: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply int
+			err = client.Call(context.Background(), "Baz.Echo", 3, &reply)
+			_assert(err == nil && reply == 3, "expect 3, got %d %v", reply, err)
+			//过大的请求和未知的方法都会被跳过，连接仍然可用
+			var s string
+			err = client.Call(context.Background(), "Baz.Types", Tagged{Name: strings.Repeat("x", 100)}, &s)
+			_assert(err != nil && strings.Contains(err.Error(), "too large"), "expect body too large, got %v", err)
+			err = client.Call(context.Background(), "Baz.Unknown", 1, &reply)
+			_assert(err != nil, "expect an error for unknown method")
+			err = client.Call(context.Background(), "Baz.Echo", 4, &s)
+			_assert(err != nil, "expect a body decode error")
+			err = client.Call(context.Background(), "Baz.Echo", 5, &reply)
+			_assert(err == nil && reply == 5, "expect 5, got %d %v", reply, err)
+
+			stream, err := client.NewStream(context.Background(), "Baz.Count", 3, new(int))
+			_assert(err == nil, "new stream: %v", err)
+			for i := 0; i < 3; i++ {
+				_assert(stream.Recv(&reply) == nil && reply == i, "expect %d, got %d", i, reply)
+			}
+			_assert(stream.Recv(&reply) == io.EOF, "expect EOF")
+
+			//流上无法解码的消息只结束这个流
+			stream, err = client.NewStream(context.Background(), "Baz.Sum", 0, new(int))
+			_assert(err == nil, "new stream: %v", err)
+			_assert(stream.Send("x") == nil, "send a bad message")
+			err = stream.Recv(&reply)
+			_assert(CodeOf(err) == InvalidArgument, "expect the server to fail the stream, got %v", err)
+			stream, err = client.NewStream(context.Background(), "Baz.Count", 3, new(string))
+			_assert(err == nil, "new stream: %v", err)
+			err = stream.Recv(&s)
+			_assert(errors.Is(err, ErrCodec), "expect the client to fail the stream, got %v", err)
+			err = client.Call(context.Background(), "Baz.Echo", 6, &reply)
+			_assert(err == nil && reply == 6, "expect 6, got %d %v", reply, err)
+		})
+	}
+}
+
+func TestFramedCodec_badHeader(t *testing.T) {
+	t.Parallel()
+	_, addr, _ := newBazServer(t)
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_assert(json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.JsonType, Framed: true}) == nil, "send option")
+
+	//无法解码的头只让这个请求失败，服务端用部分解码出的Seq应答
+	hb, bb := []byte(`{"ServiceMethod":1,"Seq":5}`), []byte("3")
+	fh := codec.FrameHeader{Version: codec.FrameVersion, HeaderLen: uint32(len(hb)), BodyLen: uint32(len(bb))}
+	_, err = conn.Write(append(append(fh.Bytes(), hb...), bb...))
+	_assert(err == nil, "send a bad header: %v", err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	cc := codec.NewFramedCodec(conn, codec.MarshalerMap[codec.JsonType], 0)
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(nil) == nil, "read reply")
+	_assert(h.Seq == 5 && Code(h.Code) == InvalidArgument, "expect InvalidArgument for seq 5, got %d %d %q", h.Seq, h.Code, h.Error)
+
+	//连接仍然可用
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Baz.Echo", Seq: 6}, 7) == nil, "send request")
+	var reply int
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(&reply) == nil, "read reply")
+	_assert(h.Seq == 6 && h.Error == "" && reply == 7, "expect 7 for seq 6, got %d %q %d", h.Seq, h.Error, reply)
+}
+
+// Repeat replies with argv copies of "tinyrpc"
+func (b Baz) Repeat(argv int, reply *string) error {
+	*reply = strings.Repeat("tinyrpc", argv)
+	return nil
+}
+
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	for _, comp := range []codec.Compression{codec.Gzip, codec.Snappy, codec.Zstd} {
+		t.Run(string(comp), func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			_assert(err == nil, "dial: %v", err)
+			cc := &countingConn{Conn: conn}
+			opt, _ := parseOptions(&Option{CodecType: codec.JsonType, Compression: comp})
+			client, err := NewClient(cc, opt)
+			_assert(err == nil, "new client: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply string
+			err = client.Call(context.Background(), "Baz.Repeat", 1, &reply)
+			_assert(err == nil && reply == "tinyrpc", "expect tinyrpc, got %q %v", reply, err)
+			before := atomic.LoadInt64(&cc.read)
+			err = client.Call(context.Background(), "Baz.Repeat", 10000, &reply)
+			_assert(err == nil && len(reply) == 70000, "expect a long reply, got %d %v", len(reply), err)
+			n := atomic.LoadInt64(&cc.read) - before
+			_assert(n < 7000, "expect a compressed reply, read %d bytes", n)
+		})
+	}
+
+	_, err := Dial("tcp", addr, &Option{Compression: "lz4"})
+	_assert(err != nil, "expect an error for unsupported compression")
+
+	//服务端不支持客户端要求的算法时回退为不压缩，编解码器不能分帧时拒绝
+	handshake := func(opt Option) handshakeReply {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial: %v", err)
+		defer func() { _ = conn.Close() }()
+		opt.MagicNumber = MagicNumber
+		_assert(json.NewEncoder(conn).Encode(&opt) == nil, "send option")
+		reply, err := readHandshakeReply(conn)
+		_assert(err == nil, "read handshake reply: %v", err)
+		return *reply
+	}
+	reply := handshake(Option{CodecType: codec.GobType, Compression: "lz4"})
+	_assert(reply.Compression == codec.NoCompression && reply.Error == "", "expect no compression, got %+v", reply)
+	reply = handshake(Option{CodecType: codec.GobType, Compression: codec.Zstd})
+	_assert(reply.Compression == codec.Zstd, "expect zstd, got %+v", reply)
+	reply = handshake(Option{CodecType: "application/unknown", Compression: codec.Gzip})
+	_assert(reply.Error != "", "expect a rejection, got %+v", reply)
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
+	"sync"
 )
 
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
@@ -17,12 +19,23 @@ const debugText = `<html>
 		<th align=center>Method</th><th align=center>Calls</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{if $mtype.ReplyType}}{{$mtype.ReplyType}}{{else}}tinyrpc.ServerStream{{end}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
 			</tr>
 		{{end}}
 		</table>
 	{{end}}
+	{{range .Tables}}
+	<hr>
+	{{.Title}}
+	<hr>
+		<table>
+		<tr>{{range .Header}}<th align=center>{{.}}</th>{{end}}</tr>
+		{{range .Rows}}
+			<tr>{{range .}}<td align=left>{{.}}</td>{{end}}</tr>
+		{{end}}
+		</table>
+	{{end}}
 	</body>
 	</html>`
 
@@ -37,6 +50,25 @@ type debugService struct {
 	Method map[string]*methodType
 }
 
+// DebugTable 调试页面上服务列表之后展示的表格，例如客户端的断路器状态
+type DebugTable struct {
+	Title  string
+	Header []string
+	Rows   [][]string
+}
+
+var debugTables sync.Map // name -> func() DebugTable
+
+// RegisterDebugTable 在调试页面上增加一个名为name的表格，每次打开页面时调用f生成内容
+//f为nil时移除这个表格
+func RegisterDebugTable(name string, f func() DebugTable) {
+	if f == nil {
+		debugTables.Delete(name)
+		return
+	}
+	debugTables.Store(name, f)
+}
+
 // Runs at /debug/geerpc
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// Build a sorted version of the data.
@@ -49,7 +81,22 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	var names []string
+	debugTables.Range(func(namei, _ interface{}) bool {
+		names = append(names, namei.(string))
+		return true
+	})
+	sort.Strings(names)
+	var tables []DebugTable
+	for _, name := range names {
+		if f, ok := debugTables.Load(name); ok {
+			tables = append(tables, f.(func() DebugTable)())
+		}
+	}
+	err := debug.Execute(w, struct {
+		Services []debugService
+		Tables   []DebugTable
+	}{services, tables})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
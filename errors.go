@@ -0,0 +1,95 @@
+package tinyrpc
+
+//客户端的错误分为两类：服务端返回的*StatusError，以及在客户端一侧发生的*CallError
+//*CallError记录了请求是否已经发出，重试层可以据此判断非幂等的调用能否安全重试
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+var (
+	// ErrShutdown 连接已经关闭
+	ErrShutdown = errors.New("connection is shut down")
+	// ErrDraining 服务端即将关闭，不再接收新的请求，请求没有被发出，可以换一个服务端重试
+	ErrDraining = errors.New("rpc client: server is draining")
+	// ErrConnectTimeout 没有在Option.ConnectTimeout内建立连接
+	ErrConnectTimeout = errors.New("rpc client: connect timeout")
+	// ErrConnectFailed 无法建立连接或完成握手
+	ErrConnectFailed = errors.New("rpc client: connect failed")
+	// ErrConnectionLost 等待应答或发送请求时连接断开
+	ErrConnectionLost = errors.New("rpc client: connection lost")
+	// ErrCodec 请求无法编码或应答无法解码
+	ErrCodec = errors.New("rpc client: codec error")
+)
+
+var (
+	// ErrNotSent 请求确定没有发给服务端，任何调用都可以安全重试
+	ErrNotSent = errors.New("rpc client: request not sent")
+	// ErrPossiblyExecuted 请求已经发出但没有拿到结果，服务端可能已经执行了它
+	ErrPossiblyExecuted = errors.New("rpc client: request possibly executed")
+)
+
+// CallError 在客户端一侧导致调用失败的错误
+//errors.Is可以用来判断错误的类别（Class），以及请求是否发出（ErrNotSent、ErrPossiblyExecuted）
+type CallError struct {
+	// 错误的类别：ErrShutdown、ErrDraining、ErrConnectTimeout、ErrConnectFailed、
+	// ErrConnectionLost、ErrCodec，或者调用者ctx的context.Canceled、context.DeadlineExceeded
+	Class error
+	// 请求是否已经完整发出，为true时服务端可能已经执行了它
+	Sent bool
+	Err  error
+}
+
+func (e *CallError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CallError) Is(target error) bool {
+	switch target {
+	case ErrNotSent:
+		return !e.Sent
+	case ErrPossiblyExecuted:
+		return e.Sent
+	}
+	return target == e.Class
+}
+
+// notSent 把err包装为没有发出请求的CallError，err已经是CallError时原样返回
+func notSent(class, err error) error {
+	if errors.As(err, new(*CallError)) {
+		return err
+	}
+	return &CallError{Class: class, Err: err}
+}
+
+// sendError 发送请求失败时区分连接错误和编码错误，两种情况服务端都不会执行请求
+func sendError(err error) error {
+	if errors.As(err, new(net.Error)) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+		return notSent(ErrConnectionLost, err)
+	}
+	return notSent(ErrCodec, err)
+}
+
+// SafeToRetry 判断调用失败后能否在不知道方法是否幂等的情况下重试：
+//请求没有发出（包括连接正在排空），或者服务端明确表示没有执行（错误详情中有NotExecuted，例如正在关闭）。
+//单独的Unavailable不算：方法自己也可能返回它，这时方法可能已经产生了副作用
+func SafeToRetry(err error) bool {
+	if errors.Is(err, ErrNotSent) || errors.Is(err, ErrDraining) {
+		return true
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		for _, d := range se.Details {
+			if _, ok := d.(NotExecuted); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
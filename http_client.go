@@ -2,6 +2,7 @@ package tinyrpc
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -43,6 +44,18 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		//没有提供TLSConfig时使用系统的根证书验证服务端
+		opt, err := parseOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		if opt.TLSConfig == nil {
+			o := *opt
+			o.TLSConfig = &tls.Config{}
+			opt = &o
+		}
+		return Dial("tcp", addr, opt)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
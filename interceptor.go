@@ -0,0 +1,90 @@
+package tinyrpc
+
+import "context"
+
+// Handler 处理一次调用，argv和replyv分别为方法的参数和应答
+type Handler func(ctx context.Context, argv, replyv interface{}) error
+
+// ServerInterceptor 服务端拦截器，在每次调用方法前后执行，可用于日志、鉴权、监控等
+// serviceMethod的格式为"Service.Method"，调用next才会继续执行后面的拦截器和方法，
+// 不调用next直接返回即可拦截这次调用，返回的error会作为应答的错误信息发给客户端
+type ServerInterceptor func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error
+
+// ServerOption 创建Server时的可选配置
+type ServerOption func(*Server)
+
+// WithInterceptors 按顺序添加服务端拦截器，第一个拦截器在最外层
+func WithInterceptors(interceptors ...ServerInterceptor) ServerOption {
+	return func(server *Server) {
+		server.interceptors = append(server.interceptors, interceptors...)
+	}
+}
+
+// PanicHandler 方法发生panic时被调用，p为panic的值，stack为panic时的调用栈
+type PanicHandler func(ctx context.Context, serviceMethod string, p interface{}, stack []byte)
+
+// WithPanicHandler 设置方法发生panic时的回调，可用于上报告警等
+// 无论是否设置，panic都会被恢复并记录日志，客户端会收到一个包含方法名的错误
+func WithPanicHandler(h PanicHandler) ServerOption {
+	return func(server *Server) {
+		server.onPanic = h
+	}
+}
+
+// chainServerInterceptors 把多个拦截器合并为一个
+func chainServerInterceptors(interceptors []ServerInterceptor) ServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+		return interceptors[0](ctx, serviceMethod, argv, replyv, chainHandler(interceptors, 1, serviceMethod, next))
+	}
+}
+
+func chainHandler(interceptors []ServerInterceptor, i int, serviceMethod string, final Handler) Handler {
+	if i == len(interceptors) {
+		return final
+	}
+	return func(ctx context.Context, argv, replyv interface{}) error {
+		return interceptors[i](ctx, serviceMethod, argv, replyv, chainHandler(interceptors, i+1, serviceMethod, final))
+	}
+}
+
+// CallInfo 描述客户端的一次调用
+type CallInfo struct {
+	ServiceMethod string // format "<service>.<method>"
+	Addr          string // 被选中的服务端地址
+}
+
+// Invoker 发起一次调用，拦截器可以多次调用它，例如实现重试
+type Invoker func(ctx context.Context, args, reply interface{}) error
+
+// ClientInterceptor 客户端拦截器，通过Option.Interceptors配置，
+// Client.Go、Client.Call以及XClient.Call、XClient.Broadcast发起的每次调用都会经过它，
+// 可用于监控、重试、通过NewOutgoingContext注入Metadata等
+type ClientInterceptor func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error
+
+// chainClientInterceptors 把多个拦截器合并为一个，第一个拦截器在最外层
+func chainClientInterceptors(interceptors []ClientInterceptor) ClientInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		return interceptors[0](ctx, info, args, reply, chainInvoker(interceptors, 1, info, next))
+	}
+}
+
+func chainInvoker(interceptors []ClientInterceptor, i int, info *CallInfo, final Invoker) Invoker {
+	if i == len(interceptors) {
+		return final
+	}
+	return func(ctx context.Context, args, reply interface{}) error {
+		return interceptors[i](ctx, info, args, reply, chainInvoker(interceptors, i+1, info, final))
+	}
+}
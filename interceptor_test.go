@@ -0,0 +1,92 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServer_interceptors(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) ServerInterceptor {
+		return func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+			mu.Lock()
+			trace = append(trace, name+">"+serviceMethod)
+			mu.Unlock()
+			err := next(ctx, argv, replyv)
+			mu.Lock()
+			trace = append(trace, name+"<")
+			mu.Unlock()
+			return err
+		}
+	}
+	auth := func(ctx context.Context, serviceMethod string, argv, replyv interface{}, next Handler) error {
+		if argv.(int) < 0 {
+			return errors.New("permission denied")
+		}
+		return next(ctx, argv, replyv)
+	}
+
+	server := NewServer(WithInterceptors(record("a"), record("b")), WithInterceptors(auth))
+	_assert(server.Register(Baz{}) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Baz.Echo", 3, &reply)
+	_assert(err == nil && reply == 3, "call: %v", err)
+	_assert(strings.Join(trace, ",") == "a>Baz.Echo,b>Baz.Echo,b<,a<", "unexpected order %v", trace)
+
+	err = client.Call(context.Background(), "Baz.Echo", -1, &reply)
+	_assert(err != nil && err.Error() == "permission denied", "expect the interceptor error, got %v", err)
+}
+
+func TestClient_interceptors(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	var mu sync.Mutex
+	var infos []CallInfo
+	inject := func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		mu.Lock()
+		infos = append(infos, *info)
+		mu.Unlock()
+		return next(NewOutgoingContext(ctx, Metadata{"trace": "injected"}), args, reply)
+	}
+	var attempts int
+	retry := func(ctx context.Context, info *CallInfo, args, reply interface{}, next Invoker) error {
+		attempts++
+		if err := next(ctx, args, reply); err == nil || attempts > 1 {
+			return err
+		}
+		attempts++
+		return next(ctx, args, reply)
+	}
+	client, err := Dial("tcp", addr, &Option{Interceptors: []ClientInterceptor{inject, retry}})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var trace string
+	err = client.Call(context.Background(), "Baz.Trace", 1, &trace)
+	_assert(err == nil && trace == "injected", "expect injected metadata, got %q %v", trace, err)
+	_, port, _ := net.SplitHostPort(addr)
+	_assert(infos[0].ServiceMethod == "Baz.Trace" && strings.HasSuffix(infos[0].Addr, ":"+port), "unexpected call info %+v", infos[0])
+
+	call := <-client.Go("Baz.Trace", 2, &trace, nil).Done
+	_assert(call.Error == nil && trace == "injected", "expect injected metadata, got %q %v", trace, call.Error)
+	_assert(call.Seq != 0 && call.Trailer["served-by"] == "baz", "expect seq and trailer, got %d %v", call.Seq, call.Trailer)
+
+	attempts = 0
+	var reply int
+	err = client.Call(context.Background(), "Baz.Nope", 1, &reply)
+	_assert(err != nil && attempts == 2, "expect a retried error, got %d attempts", attempts)
+}
@@ -0,0 +1,111 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Metadata 随请求或应答一起传输的键值对，例如trace id、租户id、鉴权token等，
+// 这样就不需要把这些信息塞进每个方法的参数里
+// 请求中的Metadata由客户端通过ctx设置，应答中的Metadata（trailer）由服务端的方法设置
+type Metadata map[string]string
+
+// Copy 返回md的一份拷贝
+func (md Metadata) Copy() Metadata {
+	if md == nil {
+		return nil
+	}
+	c := make(Metadata, len(md))
+	for k, v := range md {
+		c[k] = v
+	}
+	return c
+}
+
+type (
+	outgoingKey struct{}
+	incomingKey struct{}
+	trailerKey  struct{}
+	// 服务端和客户端的trailer使用不同的key，避免方法中发起的嵌套调用互相覆盖
+	serverTrailerKey struct{}
+)
+
+// NewOutgoingContext 返回一个附带了md的ctx，用这个ctx发起的调用会把md发送给服务端
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// FromOutgoingContext 返回ctx中将要发送给服务端的Metadata
+func FromOutgoingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md, ok
+}
+
+// FromIncomingContext 在服务端的方法中使用，返回客户端随请求发送的Metadata
+func FromIncomingContext(ctx context.Context) (Metadata, bool) {
+	md, ok := ctx.Value(incomingKey{}).(Metadata)
+	return md, ok
+}
+
+// WithTrailer 在客户端使用，调用返回后服务端设置的trailer会被写入md
+//同一个ctx可能被多个客户端的调用同时使用（如xclient的Broadcast），写入md时会加锁，
+//但调用者只能在调用返回后读取md
+func WithTrailer(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, trailerKey{}, &clientTrailer{md: md})
+}
+
+// MergeTrailer 把md合并到ctx中由WithTrailer提供的md里，ctx没有设置WithTrailer时什么也不做
+//xclient这样在多个客户端上转发调用的代码，用它把选中的调用的trailer交给调用者
+func MergeTrailer(ctx context.Context, md Metadata) {
+	if t, ok := ctx.Value(trailerKey{}).(*clientTrailer); ok {
+		t.merge(md)
+	}
+}
+
+// clientTrailer 保存WithTrailer提供的md和保护它的锁
+type clientTrailer struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+func (t *clientTrailer) merge(md Metadata) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		return
+	}
+	for k, v := range md {
+		t.md[k] = v
+	}
+}
+
+// serverTrailer 保存服务端方法设置的trailer，方法可能在多个goroutine中设置，所以需要加锁
+type serverTrailer struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+// SetTrailer 在服务端的方法中使用，md会随应答一起返回给客户端
+// 多次调用时会合并，相同的key以最后一次为准
+func SetTrailer(ctx context.Context, md Metadata) error {
+	t, ok := ctx.Value(serverTrailerKey{}).(*serverTrailer)
+	if !ok {
+		return errors.New("rpc: SetTrailer called outside of a service method")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		t.md = make(Metadata, len(md))
+	}
+	for k, v := range md {
+		t.md[k] = v
+	}
+	return nil
+}
+
+func (t *serverTrailer) get() Metadata {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md.Copy()
+}
@@ -0,0 +1,40 @@
+package tinyrpc
+
+import (
+	"context"
+	"testing"
+	"tinyrpc/codec"
+)
+
+// Trace replies with the incoming "trace" metadata and sets a trailer
+func (b Baz) Trace(ctx context.Context, argv int, reply *string) error {
+	md, _ := FromIncomingContext(ctx)
+	*reply = md["trace"]
+	return SetTrailer(ctx, Metadata{"served-by": "baz"})
+}
+
+func TestMetadata(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ})
+			_assert(err == nil, "dial: %v", err)
+			defer func() { _ = client.Close() }()
+
+			trailer := Metadata{}
+			ctx := NewOutgoingContext(context.Background(), Metadata{"trace": "abc"})
+			ctx = WithTrailer(ctx, trailer)
+			var reply string
+			err = client.Call(ctx, "Baz.Trace", 1, &reply)
+			_assert(err == nil, "call: %v", err)
+			_assert(reply == "abc", "expect trace abc, got %q", reply)
+			_assert(trailer["served-by"] == "baz", "expect trailer, got %v", trailer)
+		})
+	}
+}
+
+func TestSetTrailer_outsideMethod(t *testing.T) {
+	err := SetTrailer(context.Background(), Metadata{"k": "v"})
+	_assert(err != nil, "expect an error outside of a service method")
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,8 +19,9 @@ type GeeRegistry struct {
 
 // ServerItem 服务器信息
 type ServerItem struct {
-	Addr  string    //服务器地址
-	start time.Time //用于判断服务器是否存货
+	Addr   string    //服务器地址
+	Weight int       //服务器权重，用于加权的负载均衡
+	start  time.Time //用于判断服务器是否存货
 }
 
 const (
@@ -38,31 +40,32 @@ func New(timeout time.Duration) *GeeRegistry {
 
 var DefaultGeeRegister = New(defaultTimeout)
 
-//往注册中心中添加服务，传入的是服务器地址
-func (r *GeeRegistry) putServer(addr string) {
+//往注册中心中添加服务，传入的是服务器地址和权重，心跳可以更新权重
+func (r *GeeRegistry) putServer(addr string, weight int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	s := r.servers[addr]
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+		r.servers[addr] = &ServerItem{Addr: addr, Weight: weight, start: time.Now()}
 	} else {
+		s.Weight = weight
 		s.start = time.Now() // if exists, update start time to keep alive
 	}
 }
 
-//返回一个切片，内部包含所有存活服务器的信息
-func (r *GeeRegistry) aliveServers() []string {
+//返回一个切片，内部包含所有存活服务器的信息，按地址排序
+func (r *GeeRegistry) aliveServers() []ServerItem {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
+	var alive []ServerItem
 	for addr, s := range r.servers {
 		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
+			alive = append(alive, *s)
 		} else {
 			delete(r.servers, addr)
 		}
 	}
-	sort.Strings(alive)
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
 	return alive
 }
 
@@ -71,7 +74,16 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		// keep it simple, server is in req.Header
-		w.Header().Set("X-tinyrpc-Servers", strings.Join(r.aliveServers(), ","))
+		//权重按相同的顺序放在X-tinyrpc-Weights中，不关心权重的客户端可以忽略它
+		alive := r.aliveServers()
+		addrs := make([]string, 0, len(alive))
+		weights := make([]string, 0, len(alive))
+		for _, s := range alive {
+			addrs = append(addrs, s.Addr)
+			weights = append(weights, strconv.Itoa(s.Weight))
+		}
+		w.Header().Set("X-tinyrpc-Servers", strings.Join(addrs, ","))
+		w.Header().Set("X-tinyrpc-Weights", strings.Join(weights, ","))
 	case "POST":
 		// keep it simple, server is in req.Header
 		addr := req.Header.Get("X-tinyrpc-Server")
@@ -79,7 +91,8 @@ func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		weight, _ := strconv.Atoi(req.Header.Get("X-tinyrpc-Weight"))
+		r.putServer(addr, weight)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -98,24 +111,29 @@ func HandleHTTP() {
 // Heartbeat send a heartbeat message every once in a while
 // it's a helper function for a server to register or send heartbeat
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatWithWeight(registry, addr, 0, duration)
+}
+
+// HeartbeatWithWeight 和Heartbeat一样，同时上报服务器的权重，权重小于等于0时按1处理
+func HeartbeatWithWeight(registry, addr string, weight int, duration time.Duration) {
 	if duration == 0 {
 		// make sure there is enough time to send heart beat
 		// before it's removed from registry
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(registry, addr, weight)
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(registry, addr, weight)
 		}
 	}()
 }
 
 //服务器放松心跳包给注册中心，怎么自己还存活
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(registry, addr string, weight int) error {
 	log.Println(addr, "send heart beat to registry", registry)
 	//创建一个http客户端
 	httpClient := &http.Client{}
@@ -123,6 +141,9 @@ func sendHeartbeat(registry, addr string) error {
 	req, _ := http.NewRequest("POST", registry, nil)
 	//将服务器地址存在请求头
 	req.Header.Set("X-tinyrpc-Server", addr)
+	if weight > 0 {
+		req.Header.Set("X-tinyrpc-Weight", strconv.Itoa(weight))
+	}
 	//发送
 	if _, err := httpClient.Do(req); err != nil {
 		log.Println("rpc server: heart beat err:", err)
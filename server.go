@@ -3,6 +3,9 @@ package tinyrpc
 // 监听--->获取连接--->读取请求--->处理请求--->应答
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +13,7 @@ import (
 	"log"
 	"net"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +26,9 @@ type request struct {
 	argv, replyv reflect.Value // argv and replyv of request
 	mtype        *methodType
 	svc          *service
+	ctx          context.Context // 请求超时、连接断开或客户端取消时被取消
+	cancel       context.CancelFunc
+	trailer      *serverTrailer // 方法通过SetTrailer设置的trailer
 }
 
 // MagicNumber 魔数通常用于标识RPC协议的版本和类型
@@ -33,6 +40,25 @@ type Option struct {
 	CodecType      codec.Type
 	ConnectTimeout time.Duration // 0 means no limit
 	HandleTimeout  time.Duration
+	// 使用分帧传输，消息体可以被跳过，出错时只有这个调用或流失败，不会破坏连接上后续的消息
+	// 分帧传输需要显式开启（设置Compression时也会开启），默认仍然由编解码器直接读写连接
+	Framed bool
+	// 消息体的压缩算法，双方都用它压缩发送的消息体，设置后自动使用分帧传输
+	// 服务端在握手中回复它选择的算法：不支持时回退为不压缩，编解码器不能分帧时拒绝连接
+	Compression codec.Compression
+	// 小于该长度的消息体不压缩，只对本端发送的消息生效，0表示使用默认值
+	CompressMinSize int `json:"-"`
+	// 客户端接收应答时允许的最大消息体，只在分帧传输或使用protobuf时生效，0表示使用默认值
+	MaxBodySize uint32 `json:"-"`
+	// 客户端拦截器，只在客户端生效，不会发送给服务端
+	Interceptors []ClientInterceptor `json:"-"`
+	// 连接级的凭证，在握手时发送给服务端，由服务端的Authenticator验证
+	//凭证以明文发送，没有TLS时可能被窃听并冒用，应当只在TLS连接上使用
+	Credentials Metadata
+	// 为每次调用生成凭证，例如HMACCredentials
+	CallCredentials CallCredentials `json:"-"`
+	// 客户端使用TLS连接服务端，双向认证时在其中设置客户端证书
+	TLSConfig *tls.Config `json:"-"`
 }
 
 // DefaultOption 默认的版本和编解码方式
@@ -44,25 +70,57 @@ var DefaultOption = &Option{
 
 // Server 服务端结构体
 type Server struct {
-	serviceMap sync.Map
+	serviceMap   sync.Map
+	interceptors []ServerInterceptor
+	intercept    ServerInterceptor // interceptors合并后的结果，没有拦截器时为nil
+	onPanic      PanicHandler
+	maxBodySize  uint32 // 分帧传输或使用protobuf时允许的最大请求体
+	authn        Authenticator
+	authz        Authorizer
+
+	mu         sync.Mutex                // protect following
+	listeners  map[net.Listener]struct{} // 第一次使用时创建，零值的Server也可以使用
+	conns      map[*serverConn]struct{}
+	inShutdown bool // 调用了Shutdown或Close
 }
 
 var DefaultServer = NewServer() // 创建一个默认的服务端
 var invalidRequest = struct{}{} //处理请求错误时作为reply
 
 // NewServer 服务器构造函数
-func NewServer() *Server {
-	return &Server{}
+func NewServer(opts ...ServerOption) *Server {
+	server := &Server{}
+	for _, opt := range opts {
+		opt(server)
+	}
+	server.intercept = chainServerInterceptors(server.interceptors)
+	return server
+}
+
+// WithMaxBodySize 设置分帧传输或使用protobuf等实现了codec.BodyLimiter的编解码器时允许的最大请求体，
+//超过时服务端跳过该请求并返回错误
+func WithMaxBodySize(n uint32) ServerOption {
+	return func(server *Server) {
+		server.maxBodySize = n
+	}
 }
 
 // Accept 使用Accept()去接收一个连接
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		//lis.Accept()会阻塞直到接收到建立连接的请求
 		//随后创建conn实例，代表着一个连接
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc r: accept error:", err)
+			//Shutdown或Close会关闭listener，这时的错误是预期的
+			if !server.shuttingDown() {
+				log.Println("rpc r: accept error:", err)
+			}
 			return
 		}
 		//当拿到连接后，首先要从option中核对各种信息
@@ -76,8 +134,19 @@ func (server *Server) Accept(lis net.Listener) {
 //| <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
+	//TLS连接先完成握手，方法可以通过ctx取得对端证书
+	ctx := context.Background()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("rpc r: tls handshake error:", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		ctx = context.WithValue(ctx, tlsStateKey{}, &state)
+	}
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc r: options error: ", err)
 		return
 	}
@@ -86,21 +155,138 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 		log.Printf("rpc r: invalid magic number %x", opt.MagicNumber)
 		return
 	}
+	//客户端要求压缩时回复协商的结果
+	if opt.Compression != codec.NoCompression {
+		reply := negotiate(&opt)
+		if err := json.NewEncoder(conn).Encode(reply); err != nil || reply.Error != "" {
+			log.Println("rpc r: handshake rejected:", reply.Error, err)
+			return
+		}
+	}
 	//根据 CodecType选择解码方式
-	//codec.NewCodecFuncMap[opt.CodecType]返回的是一个编码器的构造函数，所以f是一个编码器的构造函数
+	//json.Decoder会预读连接中的数据，紧跟在option之后的请求可能已经被读进了它的缓冲区
+	cc, err := newCodec(newOptionConn(conn, dec), &opt, server.maxBodySize)
+	if err != nil {
+		log.Println("rpc r:", err)
+		return
+	}
+	//最后把编码器传进serveCodec（），解析数据
+	server.serveCodec(ctx, cc, opt)
+}
+
+// newCodec 根据option为conn创建编解码器，客户端和服务端共用
+func newCodec(conn io.ReadWriteCloser, opt *Option, maxBodySize uint32) (codec.Codec, error) {
+	if opt.Framed || opt.Compression != codec.NoCompression {
+		m := codec.MarshalerMap[opt.CodecType]
+		if m == nil {
+			return nil, fmt.Errorf("invalid codec type %s for framing", opt.CodecType)
+		}
+		cc := codec.NewFramedCodec(conn, m, maxBodySize)
+		if err := cc.SetCompression(opt.Compression, opt.CompressMinSize); err != nil {
+			return nil, err
+		}
+		return cc, nil
+	}
+	//codec.NewCodecFuncMap[opt.CodecType]返回的是一个编码器的构造函数
 	f := codec.NewCodecFuncMap[opt.CodecType]
 	if f == nil {
-		log.Printf("rpc r: invalid codec type %s", opt.CodecType)
-		return
+		return nil, fmt.Errorf("invalid codec type %s", opt.CodecType)
 	}
-	//f(conn)返回的是一个编码器,此步骤是位conn创建一个配置一个解码器和编码器
 	cc := f(conn)
-	//最后把编码器传进serveCodec（），解析数据
-	server.serveCodec(cc, opt)
+	if l, ok := cc.(codec.BodyLimiter); ok {
+		l.SetMaxBodySize(maxBodySize)
+	}
+	return cc, nil
 }
-func (server *Server) serveCodec(cc codec.Codec, opt Option) {
+
+// handshakeReply 客户端在Option中要求压缩时，服务端在option之后回复的协商结果
+type handshakeReply struct {
+	// 服务端选择的压缩算法，不支持客户端要求的算法时为NoCompression
+	Compression codec.Compression
+	// 不为空时服务端拒绝了连接
+	Error string `json:",omitempty"`
+}
+
+// negotiate 选择opt中的压缩算法，opt会被修改为协商后的结果
+func negotiate(opt *Option) handshakeReply {
+	if codec.MarshalerMap[opt.CodecType] == nil {
+		return handshakeReply{Error: fmt.Sprintf("codec type %s can not be framed for compression", opt.CodecType)}
+	}
+	if !opt.Compression.Supported() {
+		opt.Compression = codec.NoCompression
+	}
+	opt.Framed = true
+	return handshakeReply{Compression: opt.Compression}
+}
+
+// readHandshakeReply 逐字节读取一行握手回复，不能多读，之后的数据属于编解码器
+func readHandshakeReply(r io.Reader) (*handshakeReply, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1<<10 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			var reply handshakeReply
+			if err := json.Unmarshal(line, &reply); err != nil {
+				return nil, err
+			}
+			return &reply, nil
+		}
+		line = append(line, b[0])
+	}
+	return nil, errors.New("handshake reply too long")
+}
+
+// optionConn 先读出json.Decoder中缓冲的数据，再继续从连接中读取
+type optionConn struct {
+	r       *bufio.Reader
+	conn    io.ReadWriteCloser
+	started bool
+}
+
+func newOptionConn(conn io.ReadWriteCloser, dec *json.Decoder) *optionConn {
+	return &optionConn{
+		r:    bufio.NewReader(io.MultiReader(dec.Buffered(), conn)),
+		conn: conn,
+	}
+}
+
+func (c *optionConn) Read(p []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		// json.Encoder会在option后面写入一个换行符，需要跳过
+		if b, err := c.r.Peek(1); err == nil && b[0] == '\n' {
+			_, _ = c.r.Discard(1)
+		}
+	}
+	return c.r.Read(p)
+}
+
+func (c *optionConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *optionConn) Close() error {
+	return c.conn.Close()
+}
+
+func (server *Server) serveCodec(ctx context.Context, cc codec.Codec, opt Option) {
 	sending := new(sync.Mutex) // make sure to send a complete response，控制
-	wg := new(sync.WaitGroup)  // wait until all request are handled
+	sc := &serverConn{cc: cc, sending: sending}
+	wg := &sc.wg // wait until all request are handled
+	if !server.trackConn(sc, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(sc, false)
+	//连接断开时取消所有正在处理的请求
+	if opt.Credentials != nil {
+		ctx = context.WithValue(ctx, credentialsKey{}, opt.Credentials)
+	}
+	connCtx, cancelConn := context.WithCancel(ctx)
+	calls := newInflight()
 	for {
 		//从连接中解析出请求
 		req, err := server.readRequest(cc)
@@ -109,23 +295,132 @@ func (server *Server) serveCodec(cc codec.Codec, opt Option) {
 				break // it's not possible to recover, so close the connection
 			}
 			//如解析过程中出现错误，将错误信息写进应答，并返回
-			req.h.Error = err.Error()
+			setError(req.h, err)
 			server.sendResponse(cc, req.h, invalidRequest, sending)
 			continue
 		}
-		wg.Add(1)
+		//取消消息以及客户端在流上发送的消息，不需要应答
+		if req.h.Kind != codec.KindCall {
+			if err = calls.receive(cc, req.h); err != nil {
+				break
+			}
+			continue
+		}
+		//服务端正在关闭，不再处理新的请求
+		if !sc.add() {
+			setError(req.h, errServerShutdown)
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		//取客户端剩余时间和HandleTimeout中较小的一个作为超时时间
+		//流式调用通常持续较长时间，只受客户端剩余时间的限制
+		timeout := opt.HandleTimeout
+		if req.mtype.stream {
+			timeout = 0
+		}
+		if req.h.Timeout > 0 && (timeout == 0 || req.h.Timeout < timeout) {
+			timeout = req.h.Timeout
+		}
+		var cancel context.CancelFunc
+		if timeout > 0 {
+			req.ctx, cancel = context.WithTimeout(connCtx, timeout)
+		} else {
+			req.ctx, cancel = context.WithCancel(connCtx)
+		}
+		req.ctx = context.WithValue(req.ctx, incomingKey{}, Metadata(req.h.Metadata))
+		req.trailer = new(serverTrailer)
+		req.ctx = context.WithValue(req.ctx, serverTrailerKey{}, req.trailer)
+		var stream *serverStream
+		if req.mtype.stream {
+			stream = newServerStream(req.ctx, cc, sending, req)
+			req.replyv = reflect.ValueOf(stream)
+		}
+		req.cancel = calls.add(req.h.Seq, cancel, stream)
+		if stream != nil {
+			stream.cancel = req.cancel
+		}
 		//处理请求，sending, wg用于并发控制，cc用于发送应答。req是请求消息
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		go server.handleRequest(cc, req, sending, wg, timeout)
 	}
+	cancelConn()
 	wg.Wait()
 	_ = cc.Close()
 }
 
+// inflight 记录一个连接上正在处理的请求，收到取消消息时根据Seq找到并取消它，
+// 收到流消息时根据Seq找到对应的流
+type inflight struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+	streams map[uint64]*serverStream
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		cancels: make(map[uint64]context.CancelFunc),
+		streams: make(map[uint64]*serverStream),
+	}
+}
+
+// add 记录seq对应的cancel和流（普通调用为nil），返回的函数会在取消ctx的同时移除记录
+func (f *inflight) add(seq uint64, cancel context.CancelFunc, stream *serverStream) context.CancelFunc {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[seq] = cancel
+	if stream != nil {
+		f.streams[seq] = stream
+	}
+	return func() {
+		f.mu.Lock()
+		delete(f.cancels, seq)
+		delete(f.streams, seq)
+		f.mu.Unlock()
+		cancel()
+	}
+}
+
+func (f *inflight) cancel(seq uint64) {
+	f.mu.Lock()
+	cancel := f.cancels[seq]
+	f.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (f *inflight) stream(seq uint64) *serverStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[seq]
+}
+
+// receive 处理一条不是请求的消息，并读取它的消息体
+func (f *inflight) receive(cc codec.Codec, h *codec.Header) error {
+	if h.Kind == codec.KindCancel {
+		f.cancel(h.Seq)
+		return cc.ReadBody(nil)
+	}
+	if stream := f.stream(h.Seq); stream != nil {
+		return stream.receive(h)
+	}
+	// 流已经结束，丢弃客户端发送的消息
+	return cc.ReadBody(nil)
+}
+
 func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 
 	//读取头
 	h := new(codec.Header)
 	err := cc.ReadHeader(h)
+	if errors.As(err, new(*codec.HeaderError)) {
+		log.Println("rpc r: read header error:", err)
+		//消息已被跳过，连接仍然可用；用部分解码出的Seq应答错误，不是调用时Seq为0，客户端会忽略这个应答
+		reply := &codec.Header{}
+		if h.Kind == codec.KindCall {
+			reply.Seq = h.Seq
+		}
+		return &request{h: reply}, Errorf(InvalidArgument, "rpc r: read header err: %v", err)
+	}
 	if err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Println("rpc r: read header error:", err)
@@ -134,13 +429,28 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	//根据读取到的头信息创建一个请求
 	req := &request{h: h}
+	//不是请求的消息由serveCodec读取消息体
+	if h.Kind != codec.KindCall {
+		return req, nil
+	}
 	//找到要请求的服务和该服务下的方法
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		//跳过消息体，否则它会被当作下一个请求头读取
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
+	//编解码器对消息体类型有要求时，先检查方法的参数和返回值类型
+	if tc, ok := cc.(codec.TypeChecker); ok {
+		if err = checkTypes(tc, req.mtype); err != nil {
+			_ = cc.ReadBody(nil)
+			return req, Errorf(InvalidArgument, "rpc r: method %s: %v", h.ServiceMethod, err)
+		}
+	}
 	req.argv = req.mtype.newArgv()
-	req.replyv = req.mtype.newReplyv()
+	if !req.mtype.stream {
+		req.replyv = req.mtype.newReplyv()
+	}
 	// day 1, just suppose it's string
 	//常用于动态创建新的变量或对象。此时创建一个string变量
 	argvi := req.argv.Interface()
@@ -149,41 +459,102 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	}
 	if err = cc.ReadBody(argvi); err != nil {
 		log.Println("rpc r: read body err:", err)
-		return req, err
+		return req, Errorf(InvalidArgument, "rpc r: read body err: %v", err)
 	}
 	return req, nil
 }
 
+func checkTypes(tc codec.TypeChecker, m *methodType) error {
+	if err := tc.CheckType(m.ArgType); err != nil {
+		return err
+	}
+	if m.ReplyType == nil {
+		return nil
+	}
+	return tc.CheckType(m.ReplyType)
+}
+
 //处理请求
+//方法在单独的goroutine中执行，超时、连接断开或客户端取消时req.ctx被取消，
+//接收context.Context的方法可以据此提前返回，超时后方法的执行结果不再发送
 func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	defer req.cancel()
+	//流式方法以一条没有消息体的结束消息作为应答
+	var reply interface{} = invalidRequest
+	if req.mtype.stream {
+		req.h.Kind = codec.KindStreamEnd
+	}
+	stream, _ := req.replyv.Interface().(*serverStream)
+	called := make(chan error, 1)
 	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.replyv)
-		called <- struct{}{}
+		called <- server.call(req)
+	}()
+
+	select {
+	case err := <-called:
+		//应答复用了请求头，Metadata要换成方法设置的trailer
+		req.h.Metadata = req.trailer.get()
+		if stream != nil && stream.failure() != nil {
+			err = stream.failure()
+		}
 		if err != nil {
-			req.h.Error = err.Error()
+			setError(req.h, err)
 			server.sendResponse(cc, req.h, invalidRequest, sending)
-			sent <- struct{}{}
 			return
 		}
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		sent <- struct{}{}
-	}()
+		if !req.mtype.stream {
+			reply = req.replyv.Interface()
+		}
+		server.sendResponse(cc, req.h, reply, sending)
+	case <-req.ctx.Done():
+		//流因为客户端的消息无法解码而失败，用结束消息通知客户端
+		if stream != nil && stream.failure() != nil {
+			req.h.Metadata = req.trailer.get()
+			setError(req.h, stream.failure())
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			return
+		}
+		// 连接已经断开时无需应答
+		if req.ctx.Err() == context.DeadlineExceeded {
+			req.h.Metadata = nil
+			setError(req.h, Errorf(DeadlineExceeded, "rpc r: request handle timeout: expect within %s", timeout))
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+		}
+	}
+}
 
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
+// call 经过拦截器调用请求的方法
+// 方法或拦截器中的panic会被恢复并作为错误返回给客户端，不会导致整个进程崩溃
+func (server *Server) call(req *request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			stack := make([]byte, 64<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			log.Printf("rpc r: panic in %s: %v\n%s", req.h.ServiceMethod, p, stack)
+			if server.onPanic != nil {
+				server.onPanic(req.ctx, req.h.ServiceMethod, p, stack)
+			}
+			err = Errorf(Internal, "rpc r: method %s panicked: %v", req.h.ServiceMethod, p)
+		}
+	}()
+	//认证和授权，流式方法的ctx也需要带上调用者
+	ctx := req.ctx
+	if server.authn != nil || server.authz != nil {
+		if ctx, err = server.authenticate(ctx, req.h.ServiceMethod); err != nil {
+			return err
+		}
+		if stream, ok := req.replyv.Interface().(*serverStream); ok {
+			stream.ctx = ctx
+		}
 	}
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc r: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case <-called:
-		<-sent
+	if server.intercept == nil {
+		return req.svc.call(ctx, req.mtype, req.argv, req.replyv)
+	}
+	handler := func(ctx context.Context, argv, replyv interface{}) error {
+		return req.svc.call(ctx, req.mtype, reflect.ValueOf(argv), reflect.ValueOf(replyv))
 	}
+	return server.intercept(ctx, req.h.ServiceMethod, req.argv.Interface(), req.replyv.Interface(), handler)
 }
 
 //将应答送回
@@ -207,13 +578,13 @@ func (server *Server) Register(rcvr interface{}) error {
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.Split(serviceMethod, ".")
 	if len(dot) < 2 {
-		err = errors.New("rpc r: service/method request ill-formed: " + serviceMethod)
+		err = Errorf(InvalidArgument, "rpc r: service/method request ill-formed: %s", serviceMethod)
 		return
 	}
 	//从服务map中根据服务名加载服务
 	svci, ok := server.serviceMap.Load(dot[0])
 	if !ok {
-		err = errors.New("rpc r: can't find service " + dot[0])
+		err = Errorf(Unimplemented, "rpc r: can't find service %s", dot[0])
 		return
 	}
 	//把svci，一个接口转化为service指针
@@ -221,7 +592,7 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	//mtype = svci.method[dot[1]]
 	mtype = svc.method[dot[1]]
 	if mtype == nil {
-		err = errors.New("rpc r: can't find method " + dot[1])
+		err = Errorf(Unimplemented, "rpc r: can't find method %s", dot[1])
 	}
 	return
 }
@@ -0,0 +1,186 @@
+package tinyrpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"tinyrpc/codec"
+)
+
+type Baz struct {
+	canceled chan error
+	sent     chan int
+}
+
+func (b Baz) Slow(ctx context.Context, argv int, reply *int) error {
+	select {
+	case <-ctx.Done():
+		b.canceled <- ctx.Err()
+		return ctx.Err()
+	case <-time.After(time.Second * 5):
+		*reply = argv
+		return nil
+	}
+}
+
+func (b Baz) Echo(argv int, reply *int) error {
+	*reply = argv
+	return nil
+}
+
+// Panic panics with argv
+func (b Baz) Panic(argv int, reply *int) error {
+	panic(argv)
+}
+
+// Remaining replies with the time left before the handler ctx expires, -1 if unlimited
+func (b Baz) Remaining(ctx context.Context, argv int, reply *time.Duration) error {
+	*reply = -1
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = time.Until(deadline)
+	}
+	return nil
+}
+
+func startBazServer(t *testing.T) (string, chan error) {
+	_, addr, canceled := newBazServer(t)
+	return addr, canceled
+}
+
+// newBazServer 启动一个注册了Baz的服务端，测试结束时关闭它
+func newBazServer(t *testing.T, opts ...ServerOption) (*Server, string, chan error) {
+	b := Baz{canceled: make(chan error, 1)}
+	server := NewServer(opts...)
+	_assert(server.Register(b) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+	return server, l.Addr().String(), b.canceled
+}
+
+func TestServer_handleTimeoutCancelsContext(t *testing.T) {
+	t.Parallel()
+	addr, canceled := startBazServer(t)
+	client, err := Dial("tcp", addr, &Option{HandleTimeout: time.Millisecond * 200})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Baz.Slow", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+	select {
+	case err := <-canceled:
+		_assert(err == context.DeadlineExceeded, "expect ctx deadline exceeded, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+}
+
+func TestServer_disconnectCancelsContext(t *testing.T) {
+	t.Parallel()
+	addr, canceled := startBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+
+	client.Go("Baz.Slow", 1, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	_ = client.Close()
+	select {
+	case err := <-canceled:
+		_assert(err == context.Canceled, "expect ctx canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+}
+
+func TestServer_clientCancel(t *testing.T) {
+	t.Parallel()
+	addr, canceled := startBazServer(t)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ})
+			_assert(err == nil, "dial: %v", err)
+			defer func() { _ = client.Close() }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(time.Millisecond*200, cancel)
+			var reply int
+			err = client.Call(ctx, "Baz.Slow", 1, &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "canceled"), "expect a canceled error")
+			select {
+			case err := <-canceled:
+				_assert(err == context.Canceled, "expect ctx canceled, got %v", err)
+			case <-time.After(time.Second):
+				t.Fatal("handler context was not canceled")
+			}
+			// the connection must still be usable after a cancel message
+			err = client.Call(context.Background(), "Baz.Echo", 2, &reply)
+			_assert(err == nil && reply == 2, "call after cancel failed: %v", err)
+		})
+	}
+}
+
+func TestServer_deadlinePropagation(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	call := func(t *testing.T, opt *Option, timeout time.Duration) time.Duration {
+		client, err := Dial("tcp", addr, opt)
+		_assert(err == nil, "dial: %v", err)
+		defer func() { _ = client.Close() }()
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		var remaining time.Duration
+		err = client.Call(ctx, "Baz.Remaining", 1, &remaining)
+		_assert(err == nil, "call: %v", err)
+		return remaining
+	}
+
+	t.Run("no deadline", func(t *testing.T) {
+		_assert(call(t, nil, 0) == -1, "expect no deadline")
+	})
+	t.Run("client deadline", func(t *testing.T) {
+		remaining := call(t, &Option{HandleTimeout: time.Minute}, time.Second)
+		_assert(remaining > 0 && remaining <= time.Second, "expect the client deadline, got %s", remaining)
+	})
+	t.Run("handle timeout", func(t *testing.T) {
+		remaining := call(t, &Option{HandleTimeout: time.Second}, time.Minute)
+		_assert(remaining > 0 && remaining <= time.Second, "expect the handle timeout, got %s", remaining)
+	})
+}
+
+func TestServer_panicRecovery(t *testing.T) {
+	t.Parallel()
+	recovered := make(chan interface{}, 1)
+	_, addr, _ := newBazServer(t, WithPanicHandler(func(ctx context.Context, serviceMethod string, p interface{}, stack []byte) {
+		_assert(serviceMethod == "Baz.Panic" && len(stack) > 0, "expect the method and stack, got %s", serviceMethod)
+		recovered <- p
+	}))
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	err = client.Call(context.Background(), "Baz.Panic", 42, new(int))
+	_assert(CodeOf(err) == Internal && strings.Contains(err.Error(), "Baz.Panic"), "expect an Internal error naming the method, got %v", err)
+	select {
+	case p := <-recovered:
+		_assert(p == 42, "expect the recovered value 42, got %v", p)
+	case <-time.After(time.Second):
+		t.Fatal("panic handler was not called")
+	}
+
+	//连接和服务端都可以继续使用
+	var reply int
+	err = client.Call(context.Background(), "Baz.Echo", 1, &reply)
+	_assert(err == nil && reply == 1, "expect the connection to keep serving, got %v", err)
+	other, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = other.Close() }()
+	err = other.Call(context.Background(), "Baz.Echo", 2, &reply)
+	_assert(err == nil && reply == 2, "expect the server to keep serving, got %v", err)
+}
@@ -1,6 +1,7 @@
 package tinyrpc
 
 import (
+	"context"
 	"fmt"
 	"go/ast"
 	"log"
@@ -8,6 +9,11 @@ import (
 	"sync/atomic"
 )
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 //注册method，主要依靠的reflect包，这里需要实现学习一下reflect的一些相关知识点和主义事项
 
 //传入一个实例后，根据这个实例创建一个实例的信息，把这些信息抽象成一个服务
@@ -30,6 +36,10 @@ type methodType struct {
 	ReplyType reflect.Type
 	//方法被调用的次数
 	numCalls uint64
+	//方法的第一个参数是否为context.Context
+	hasCtx bool
+	//是否为流式方法，流式方法的最后一个参数是ServerStream，没有ReplyType
+	stream bool
 }
 
 type method struct {
@@ -61,24 +71,49 @@ func NewService(rcvr interface{}) *service {
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
 	for i := 0; i < s.typ.NumMethod(); i++ {
-		method := s.typ.Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
+		if mType := newMethodType(s.typ.Method(i)); mType != nil {
+			s.method[mType.method.Name] = mType
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
-		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
+	}
+}
+
+//newMethodType 检查方法的签名，只有以下几种形式的方法可以被注册：
+//	func (t *T) MethodName(argType T1, replyType *T2) error
+//	func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+//	func (t *T) MethodName(ctx context.Context, argType T1, stream ServerStream) error
+//接收ctx的方法在请求超时、连接断开或客户端取消时，ctx会被取消，
+//最后一个参数为ServerStream的是流式方法，ctx同样是可选的。不满足条件时返回nil
+func newMethodType(method reflect.Method) *methodType {
+	mType := method.Type
+	if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
+		return nil
+	}
+	var hasCtx bool
+	switch mType.NumIn() {
+	case 3:
+	case 4:
+		if mType.In(1) != typeOfContext {
+			return nil
 		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		hasCtx = true
+	default:
+		return nil
+	}
+	argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+	if replyType == typeOfServerStream {
+		if !isExportedOrBuiltinType(argType) {
+			return nil
 		}
-		//log.Printf("rpc r: register %s.%s\n", s.name, method.Name)
+		return &methodType{method: method, ArgType: argType, hasCtx: hasCtx, stream: true}
+	}
+	if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		return nil
+	}
+	return &methodType{
+		method:    method,
+		ArgType:   argType,
+		ReplyType: replyType,
+		hasCtx:    hasCtx,
 	}
 }
 
@@ -91,10 +126,15 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 //它接收一个反射值切片作为参数，其中包含了函数调用时需要传递的所有参数。
 //函数调用的返回值也是一个反射值切片。在这个例子中， 它被用于调用一个方法，
 //并传递了三个参数：接收器（即该方法所属的结构体实例）、 包含调用该方法时传递的参数的切片和用于存储方法调用返回值的变量的反射值。
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+//如果方法接收context.Context，ctx会作为第一个参数传入
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func //获取一个函数
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if m.hasCtx {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -137,22 +177,8 @@ func creatService(rcvr interface{}) *service {
 	s.method = make(map[string]*methodType)
 
 	for i := 0; i < reflect.TypeOf(rcvr).NumMethod(); i++ {
-		method := reflect.TypeOf(rcvr).Method(i)
-		mType := method.Type
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
-		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-			continue
-		}
-		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+		if mType := newMethodType(reflect.TypeOf(rcvr).Method(i)); mType != nil {
+			s.method[mType.method.Name] = mType
 		}
 		//log.Printf("rpc r: register %s.%s\n", s.name, method.Name)
 	}
@@ -1,6 +1,8 @@
 package tinyrpc
 
 import (
+	"context"
+	"reflect"
 	"testing"
 )
 
@@ -33,6 +35,30 @@ func (f Foo) Eum(args Args, reply *int) error {
 	return nil
 }
 
+func (f Foo) CtxSum(ctx context.Context, args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f Foo) BadCtx(args Args, ctx context.Context, reply *int) error {
+	return nil
+}
+
+func TestCreatService_ctxMethod(t *testing.T) {
+	var foo Foo
+	s := creatService(foo)
+	mType := s.method["CtxSum"]
+	_assert(mType != nil && mType.hasCtx, "CtxSum should be registered with context")
+	_assert(mType.ArgType.Name() == "Args", "wrong arg type %s", mType.ArgType)
+	_assert(s.method["BadCtx"] == nil, "BadCtx should not be registered")
+	_assert(!s.method["Sum"].hasCtx, "Sum does not take a context")
+
+	var reply int
+	argv := reflect.ValueOf(Args{Num1: 1, Num2: 3})
+	err := s.call(context.Background(), mType, argv, reflect.ValueOf(&reply))
+	_assert(err == nil && reply == 4, "call CtxSum failed: %v %d", err, reply)
+}
+
 func BenchmarkCreatService(b *testing.B) {
 	var a Foo
 	var rcvr interface{}
@@ -0,0 +1,132 @@
+package tinyrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"tinyrpc/codec"
+)
+
+//附带NotExecuted，客户端据此区分服务端的拒绝和方法自己返回的Unavailable
+var errServerShutdown = (&StatusError{Code: Unavailable, Message: "rpc r: server is shutting down"}).WithDetails(NotExecuted{})
+
+// serverConn 记录服务端一个连接的状态，关闭服务端时用于通知客户端并等待请求处理完成
+type serverConn struct {
+	cc       codec.Codec
+	sending  *sync.Mutex
+	mu       sync.Mutex     // protect following
+	wg       sync.WaitGroup // 正在处理的请求
+	draining bool           // 已经通知客户端不再接收新的请求
+}
+
+// add 登记一个新的请求，连接正在排空时返回false
+func (c *serverConn) add() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+// drain 通知客户端这个连接不再接收新的请求，已经收到的请求会继续处理
+func (c *serverConn) drain(server *Server) {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+	server.sendResponse(c.cc, &codec.Header{Kind: codec.KindGoAway}, invalidRequest, c.sending)
+}
+
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		//零值的Server没有经过NewServer，在这里创建map
+		if server.listeners == nil {
+			server.listeners = make(map[net.Listener]struct{})
+		}
+		server.listeners[lis] = struct{}{}
+	} else {
+		delete(server.listeners, lis)
+	}
+	return true
+}
+
+func (server *Server) trackConn(c *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		if server.inShutdown {
+			return false
+		}
+		if server.conns == nil {
+			server.conns = make(map[*serverConn]struct{})
+		}
+		server.conns[c] = struct{}{}
+	} else {
+		delete(server.conns, c)
+	}
+	return true
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// closeListeners 停止接收新的连接，并返回当前所有的连接
+func (server *Server) closeListeners() []*serverConn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.inShutdown = true
+	for lis := range server.listeners {
+		_ = lis.Close()
+		delete(server.listeners, lis)
+	}
+	conns := make([]*serverConn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Shutdown 优雅地关闭服务端：
+// 首先停止接收新的连接，并通知所有客户端不再接收新的请求，
+// 然后等待已经收到的请求处理完成，最后关闭所有连接。
+// 如果ctx在请求处理完成前结束，会直接关闭连接（正在处理的请求的ctx会被取消），并返回ctx.Err()
+func (server *Server) Shutdown(ctx context.Context) error {
+	conns := server.closeListeners()
+	for _, c := range conns {
+		c.drain(server)
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, c := range conns {
+			c.wg.Wait()
+		}
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, c := range conns {
+		_ = c.cc.Close()
+	}
+	return err
+}
+
+// Close 立即关闭服务端的所有listener和连接，正在处理的请求的ctx会被取消
+func (server *Server) Close() error {
+	for _, c := range server.closeListeners() {
+		_ = c.cc.Close()
+	}
+	return nil
+}
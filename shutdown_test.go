@@ -0,0 +1,88 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Sleep sleeps argv milliseconds before replying
+func (b Baz) Sleep(argv int, reply *int) error {
+	time.Sleep(time.Duration(argv) * time.Millisecond)
+	*reply = argv
+	return nil
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+	server, addr, _ := newBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Baz.Sleep", 300, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+
+	call = <-call.Done
+	_assert(call.Error == nil && *call.Reply.(*int) == 300, "in-flight call should finish: %v", call.Error)
+	_assert(<-shutdown == nil, "shutdown should finish in time")
+	_assert(!client.IsAvailable(), "client should not be available after the drain notice")
+	err = client.Call(context.Background(), "Baz.Echo", 1, new(int))
+	_assert(errors.Is(err, ErrDraining) || errors.Is(err, ErrShutdown), "expect a draining error, got %v", err)
+	_, err = Dial("tcp", addr)
+	_assert(err != nil, "server should not accept new connections")
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	t.Parallel()
+	server, addr, canceled := newBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Baz.Slow", 1, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	_assert(err == context.DeadlineExceeded, "expect deadline exceeded, got %v", err)
+	_assert(<-canceled == context.Canceled, "in-flight request should be canceled")
+	call = <-call.Done
+	_assert(call.Error != nil, "in-flight call should fail")
+}
+
+func TestServer_Close(t *testing.T) {
+	t.Parallel()
+	server, addr, canceled := newBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	call := client.Go("Baz.Slow", 1, new(int), nil)
+	time.Sleep(time.Millisecond * 100)
+	_ = server.Close()
+	_assert(<-canceled == context.Canceled, "in-flight request should be canceled")
+	call = <-call.Done
+	_assert(call.Error != nil, "in-flight call should fail")
+}
+
+func TestServer_zeroValue(t *testing.T) {
+	t.Parallel()
+	var server Server
+	_assert(server.Register(Baz{}) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+	defer func() { _ = server.Close() }()
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Baz.Echo", 7, &reply)
+	_assert(err == nil && reply == 7, "expect a zero value Server to serve calls, got %d %v", reply, err)
+}
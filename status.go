@@ -0,0 +1,247 @@
+package tinyrpc
+
+//带错误码的错误：错误码、错误信息和可选的详情随应答头发送给客户端，
+//客户端还原出*StatusError，可以用errors.Is(err, tinyrpc.NotFound)或errors.As判断错误的类别
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+	"tinyrpc/codec"
+)
+
+// Code 错误码，取值与gRPC的状态码保持一致
+//Code实现了error，可以作为errors.Is的target
+type Code uint32
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1  // 调用被调用者取消
+	Unknown            Code = 2  // 没有错误码的错误
+	InvalidArgument    Code = 3  // 参数不合法
+	DeadlineExceeded   Code = 4  // 没有在期限内完成
+	NotFound           Code = 5  // 请求的资源不存在
+	AlreadyExists      Code = 6  // 要创建的资源已经存在
+	PermissionDenied   Code = 7  // 调用者没有调用该方法的权限
+	ResourceExhausted  Code = 8  // 资源耗尽，例如配额用完
+	FailedPrecondition Code = 9  // 系统状态不满足执行的条件
+	Aborted            Code = 10 // 操作被中止，例如并发冲突
+	OutOfRange         Code = 11 // 超出有效范围
+	Unimplemented      Code = 12 // 服务或方法不存在
+	Internal           Code = 13 // 服务端内部错误
+	Unavailable        Code = 14 // 服务暂时不可用，可以重试
+	DataLoss           Code = 15 // 数据丢失或损坏
+	Unauthenticated    Code = 16 // 请求没有有效的凭证
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "Canceled",
+	Unknown:            "Unknown",
+	InvalidArgument:    "InvalidArgument",
+	DeadlineExceeded:   "DeadlineExceeded",
+	NotFound:           "NotFound",
+	AlreadyExists:      "AlreadyExists",
+	PermissionDenied:   "PermissionDenied",
+	ResourceExhausted:  "ResourceExhausted",
+	FailedPrecondition: "FailedPrecondition",
+	Aborted:            "Aborted",
+	OutOfRange:         "OutOfRange",
+	Unimplemented:      "Unimplemented",
+	Internal:           "Internal",
+	Unavailable:        "Unavailable",
+	DataLoss:           "DataLoss",
+	Unauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return fmt.Sprintf("Code(%d)", uint32(c))
+}
+
+func (c Code) Error() string {
+	return c.String()
+}
+
+// HTTPStatus 返回错误码对应的HTTP状态码，便于网关转换
+func (c Code) HTTPStatus() int {
+	switch c {
+	case OK:
+		return http.StatusOK
+	case Canceled:
+		return 499 // client closed request
+	case InvalidArgument, FailedPrecondition, OutOfRange:
+		return http.StatusBadRequest
+	case DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case NotFound:
+		return http.StatusNotFound
+	case AlreadyExists, Aborted:
+		return http.StatusConflict
+	case PermissionDenied:
+		return http.StatusForbidden
+	case ResourceExhausted:
+		return http.StatusTooManyRequests
+	case Unimplemented:
+		return http.StatusNotImplemented
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// StatusError 带错误码的错误，服务端方法或拦截器返回它时客户端能拿到相同的错误码和详情
+type StatusError struct {
+	Code    Code
+	Message string
+	// 可选的详情，类型需要通过RegisterDetail注册，客户端才能还原出相同的类型
+	Details []interface{}
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// Is 支持errors.Is(err, code)，以及与错误码和信息都相同的*StatusError比较
+func (e *StatusError) Is(target error) bool {
+	switch t := target.(type) {
+	case Code:
+		return e.Code == t
+	case *StatusError:
+		return e.Code == t.Code && e.Message == t.Message
+	}
+	return false
+}
+
+// WithDetails 返回附带了details的副本
+func (e *StatusError) WithDetails(details ...interface{}) *StatusError {
+	c := *e
+	c.Details = append(append([]interface{}(nil), e.Details...), details...)
+	return &c
+}
+
+// Errorf 创建一个带错误码的错误
+func Errorf(code Code, format string, a ...interface{}) error {
+	return &StatusError{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// StatusOf 把err转换为*StatusError，err为nil时返回nil
+//ctx的错误分别对应Canceled和DeadlineExceeded，其他没有错误码的错误为Unknown
+func StatusOf(err error) *StatusError {
+	if err == nil {
+		return nil
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		if se.Error() == err.Error() {
+			return se
+		}
+		//被包装过的错误保留外层的错误信息
+		return &StatusError{Code: se.Code, Message: err.Error(), Details: se.Details}
+	}
+	return &StatusError{Code: CodeOf(err), Message: err.Error()}
+}
+
+// CodeOf 返回err的错误码，err为nil时返回OK
+func CodeOf(err error) Code {
+	var se *StatusError
+	switch {
+	case err == nil:
+		return OK
+	case errors.As(err, &se):
+		return se.Code
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return DeadlineExceeded
+	}
+	return Unknown
+}
+
+// RetryInfo 建议客户端在RetryDelay之后重试
+type RetryInfo struct {
+	RetryDelay time.Duration
+}
+
+// BadRequest 说明哪些参数不合法
+type BadRequest struct {
+	FieldViolations []FieldViolation
+}
+
+type FieldViolation struct {
+	Field       string
+	Description string
+}
+
+// NotExecuted 说明服务端没有执行这个请求，例如服务端正在关闭时拒绝的请求，客户端可以安全地重试
+type NotExecuted struct{}
+
+var detailTypes sync.Map // name -> reflect.Type
+
+func init() {
+	RegisterDetail(RetryInfo{})
+	RegisterDetail(BadRequest{})
+	RegisterDetail(NotExecuted{})
+}
+
+// RegisterDetail 注册一种错误详情的类型，客户端和服务端都需要注册
+//详情在头中以JSON编码，与连接使用的编解码器无关
+func RegisterDetail(v interface{}) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	detailTypes.Store(detailName(t), t)
+}
+
+func detailName(t reflect.Type) string {
+	return t.PkgPath() + "." + t.Name()
+}
+
+// setError 把err的错误码、信息和详情写进应答头
+func setError(h *codec.Header, err error) {
+	se := StatusOf(err)
+	h.Error = se.Message
+	h.Code = uint32(se.Code)
+	h.Details = nil
+	for _, d := range se.Details {
+		t := reflect.TypeOf(d)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		data, jerr := json.Marshal(d)
+		if jerr != nil {
+			continue
+		}
+		h.Details = append(h.Details, codec.Detail{Type: detailName(t), Data: data})
+	}
+}
+
+// headerError 从应答头中还原错误，没有注册的详情类型会被忽略
+func headerError(h *codec.Header) error {
+	if h.Code == uint32(OK) {
+		return errors.New(h.Error)
+	}
+	se := &StatusError{Code: Code(h.Code), Message: h.Error}
+	for _, d := range h.Details {
+		t, ok := detailTypes.Load(d.Type)
+		if !ok {
+			continue
+		}
+		v := reflect.New(t.(reflect.Type))
+		if json.Unmarshal(d.Data, v.Interface()) == nil {
+			se.Details = append(se.Details, v.Elem().Interface())
+		}
+	}
+	return se
+}
@@ -0,0 +1,53 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"tinyrpc/codec"
+)
+
+// Lookup fails with a NotFound status carrying details for negative ids
+func (b Baz) Lookup(argv int, reply *int) error {
+	if argv == 0 {
+		return errors.New("100% plain")
+	}
+	if argv < 0 {
+		return (&StatusError{Code: NotFound, Message: "no user with 100% certainty"}).WithDetails(
+			RetryInfo{RetryDelay: time.Second},
+			BadRequest{FieldViolations: []FieldViolation{{Field: "id", Description: "negative"}}},
+		)
+	}
+	*reply = argv
+	return nil
+}
+
+func TestStatusError(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ})
+			_assert(err == nil, "dial: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply int
+			err = client.Call(context.Background(), "Baz.Lookup", -1, &reply)
+			var se *StatusError
+			_assert(errors.Is(err, NotFound) && errors.As(err, &se), "expect NotFound, got %v", err)
+			_assert(se.Message == "no user with 100% certainty", "message changed: %q", se.Message)
+			_assert(len(se.Details) == 2, "expect 2 details, got %v", se.Details)
+			retry, ok := se.Details[0].(RetryInfo)
+			_assert(ok && retry.RetryDelay == time.Second, "expect RetryInfo, got %#v", se.Details[0])
+			bad, ok := se.Details[1].(BadRequest)
+			_assert(ok && bad.FieldViolations[0].Field == "id", "expect BadRequest, got %#v", se.Details[1])
+
+			err = client.Call(context.Background(), "Baz.Lookup", 0, &reply)
+			_assert(CodeOf(err) == Unknown && err.Error() == "100% plain", "expect Unknown, got %v", err)
+			err = client.Call(context.Background(), "Baz.Missing", 0, &reply)
+			_assert(errors.Is(err, Unimplemented), "expect Unimplemented, got %v", err)
+			_assert(CodeOf(err).HTTPStatus() == 501, "expect 501 for Unimplemented")
+		})
+	}
+}
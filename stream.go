@@ -0,0 +1,558 @@
+package tinyrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"tinyrpc/codec"
+)
+
+// 流式调用：客户端发起一次请求后，双方都可以在同一个Seq上连续发送多条消息，
+// 和普通调用复用同一个连接。服务端的方法返回时发送结束消息，流随之结束
+// | Header{Seq, Kind: KindCall} Args |             --->
+// | Header{Seq, Kind: KindStream} Args | x N       --->
+// | Header{Seq, Kind: KindStreamEnd} |             --->  (CloseSend)
+//                                                  <--- | Header{Seq, Kind: KindStream} Reply | x N
+//                                                  <--- | Header{Seq, Kind: KindStreamEnd, Error, Metadata} |
+// 流量控制：每个方向上对端最多有streamWindow条消息没有被读取，
+// 接收方每读取一半窗口的消息，就发送一条KindWindow消息（消息体为读取的条数）归还额度，
+// 这样读取较慢的一方不会让对端的内存无限增长。接收方也检查额度，对端不等待额度继续发送时，
+// 流以ResourceExhausted结束
+
+// streamWindow 每个方向上允许对端发送但还没有被读取的消息数
+const streamWindow = 32
+
+// ServerStream 服务端流式方法用于收发消息的接口，流式方法的签名为：
+//
+//	func (t *T) MethodName(ctx context.Context, argType T1, stream tinyrpc.ServerStream) error
+//	func (t *T) MethodName(argType T1, stream tinyrpc.ServerStream) error
+//
+// argType是客户端发送的第一条消息，之后客户端发送的消息类型相同，通过Recv读取，
+// 根据方法的使用方式，可以实现服务端流、客户端流和双向流。
+// 方法返回后流随之结束，返回的error会通过结束消息发给客户端
+type ServerStream interface {
+	// Context 返回这次调用的ctx，超时、连接断开或客户端取消时被取消
+	Context() context.Context
+	// Send 向客户端发送一条消息，客户端读取较慢时会阻塞
+	Send(m interface{}) error
+	// Recv 读取客户端发送的下一条消息，m为指向T1的指针，客户端调用CloseSend后返回io.EOF
+	Recv(m interface{}) error
+}
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+
+// streamQueue 保存已经收到还没有被读取的消息
+type streamQueue struct {
+	mu     sync.Mutex // protect following
+	msgs   []reflect.Value
+	err    error         // 没有更多消息时返回的错误
+	notify chan struct{} // 有新的消息或者队列被关闭
+}
+
+func newStreamQueue() *streamQueue {
+	return &streamQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *streamQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *streamQueue) push(v reflect.Value) {
+	q.mu.Lock()
+	q.msgs = append(q.msgs, v)
+	q.mu.Unlock()
+	q.wakeup()
+}
+
+// close 关闭队列，已经收到的消息仍然可以被读取，只有第一次调用生效
+func (q *streamQueue) close(err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return false
+	}
+	q.err = err
+	q.wakeup()
+	return true
+}
+
+// pop 读取下一条消息，没有消息时阻塞，直到有新的消息、队列被关闭或者done被关闭
+func (q *streamQueue) pop(done <-chan struct{}) (reflect.Value, error) {
+	for {
+		q.mu.Lock()
+		if len(q.msgs) > 0 {
+			v := q.msgs[0]
+			q.msgs[0] = reflect.Value{}
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+			return v, nil
+		}
+		err := q.err
+		q.mu.Unlock()
+		if err != nil {
+			q.wakeup() // 让其他等待的Recv也能返回
+			return reflect.Value{}, err
+		}
+		select {
+		case <-q.notify:
+		case <-done:
+			return reflect.Value{}, context.Canceled
+		}
+	}
+}
+
+// sendWindow 发送方剩余的额度，额度用完时Send阻塞，直到对端归还额度
+type sendWindow struct {
+	mu     sync.Mutex
+	credit int
+	notify chan struct{}
+}
+
+func newSendWindow() *sendWindow {
+	return &sendWindow{credit: streamWindow, notify: make(chan struct{}, 1)}
+}
+
+func (w *sendWindow) acquire(done <-chan struct{}) bool {
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			w.credit--
+			more := w.credit > 0
+			w.mu.Unlock()
+			if more {
+				w.wakeup()
+			}
+			return true
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.notify:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (w *sendWindow) add(n int) {
+	w.mu.Lock()
+	w.credit += n
+	w.mu.Unlock()
+	w.wakeup()
+}
+
+func (w *sendWindow) wakeup() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// recvWindow 记录接收方已经读取的消息数，满一半窗口时返回需要归还的额度
+type recvWindow struct {
+	mu          sync.Mutex
+	consumed    int
+	outstanding int // 已经收到但额度还没有归还的消息数
+}
+
+// receive 记录收到一条消息，对端超出了给它的额度时返回false
+func (w *recvWindow) receive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.outstanding++
+	return w.outstanding <= streamWindow
+}
+
+func (w *recvWindow) consume() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.consumed++
+	if w.consumed < streamWindow/2 {
+		return 0
+	}
+	n := w.consumed
+	w.consumed = 0
+	w.outstanding -= n
+	return n
+}
+
+// newMsg 创建一个用于解码消息的值，t为指针类型时创建它指向的类型
+func newMsg(t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem())
+	}
+	return reflect.New(t)
+}
+
+// assignMsg 把newMsg创建并解码后的v写入m，m可以是*T，也可以是**T
+func assignMsg(m interface{}, v reflect.Value) error {
+	dst := reflect.ValueOf(m)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return errors.New("rpc: stream message must be a non-nil pointer")
+	}
+	dst = dst.Elem()
+	switch {
+	case v.Type().AssignableTo(dst.Type()):
+		dst.Set(v)
+	case v.Elem().Type().AssignableTo(dst.Type()):
+		dst.Set(v.Elem())
+	default:
+		return fmt.Errorf("rpc: stream message type %s can't be assigned to %s", v.Elem().Type(), dst.Type())
+	}
+	return nil
+}
+
+// readWindow 读取KindWindow消息的消息体，即对端归还的额度
+func readWindow(cc codec.Codec) (int, error) {
+	var n uint32
+	if err := cc.ReadBody(&n); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// serverStream ServerStream的实现，和普通的应答共用一个连接和sending锁
+type serverStream struct {
+	ctx           context.Context
+	cc            codec.Codec
+	sending       *sync.Mutex
+	serviceMethod string
+	seq           uint64
+	argType       reflect.Type // 客户端发送的消息的类型
+
+	recv    *streamQueue
+	recvWin recvWindow
+	sendWin *sendWindow
+
+	cancel context.CancelFunc // 取消方法的ctx并结束请求
+	mu     sync.Mutex         // protect err
+	err    error              // 流因为客户端的消息无法解码或者超出额度而失败
+}
+
+var _ ServerStream = (*serverStream)(nil)
+
+func newServerStream(ctx context.Context, cc codec.Codec, sending *sync.Mutex, req *request) *serverStream {
+	return &serverStream{
+		ctx:           ctx,
+		cc:            cc,
+		sending:       sending,
+		serviceMethod: req.h.ServiceMethod,
+		seq:           req.h.Seq,
+		argType:       req.mtype.ArgType,
+		recv:          newStreamQueue(),
+		sendWin:       newSendWindow(),
+	}
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) Send(m interface{}) error {
+	if !s.sendWin.acquire(s.ctx.Done()) {
+		return s.ctx.Err()
+	}
+	//请求已经结束，结束消息已经或即将发出，不能再发送
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	return s.write(codec.KindStream, m)
+}
+
+func (s *serverStream) Recv(m interface{}) error {
+	v, err := s.recv.pop(s.ctx.Done())
+	if err == context.Canceled {
+		err = s.ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if n := s.recvWin.consume(); n > 0 {
+		_ = s.write(codec.KindWindow, uint32(n))
+	}
+	return assignMsg(m, v)
+}
+
+func (s *serverStream) write(kind codec.Kind, body interface{}) error {
+	h := &codec.Header{ServiceMethod: s.serviceMethod, Seq: s.seq, Kind: kind}
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	return s.cc.Encode(h, body)
+}
+
+// receive 在serveCodec中被调用，处理客户端在这个流上发送的一条消息
+func (s *serverStream) receive(h *codec.Header) error {
+	switch h.Kind {
+	case codec.KindStream:
+		//客户端没有等待额度，丢弃消息并结束这个流，避免队列无限增长
+		if !s.recvWin.receive() {
+			s.fail(Errorf(ResourceExhausted, "rpc r: stream window of %d messages exceeded", streamWindow))
+			return s.cc.ReadBody(nil)
+		}
+		v := newMsg(s.argType)
+		if err := s.cc.ReadBody(v.Interface()); err != nil {
+			//分帧传输时消息体已经被完整读出，只结束这个流
+			if errors.As(err, new(*codec.BodyError)) {
+				s.fail(Errorf(InvalidArgument, "rpc r: read stream message: %v", err))
+				return nil
+			}
+			return err
+		}
+		s.recv.push(v)
+	case codec.KindStreamEnd:
+		s.recv.close(io.EOF)
+		return s.cc.ReadBody(nil)
+	case codec.KindWindow:
+		n, err := readWindow(s.cc)
+		if err != nil {
+			return err
+		}
+		s.sendWin.add(n)
+	default:
+		return s.cc.ReadBody(nil)
+	}
+	return nil
+}
+
+// fail 结束这个流：方法的Recv返回err，方法的ctx被取消，handleRequest用err发送结束消息
+func (s *serverStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.recv.close(err)
+	s.cancel()
+}
+
+func (s *serverStream) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// ClientStream 客户端的一个流，通过Send发送消息，通过Recv依次读取服务端发送的消息
+type ClientStream struct {
+	client    *Client
+	seq       uint64
+	replyType reflect.Type // 每条消息都解码成这个类型
+	cancel    context.CancelFunc
+
+	recv    *streamQueue
+	recvWin recvWindow
+	sendWin *sendWindow
+
+	mu         sync.Mutex // protect following
+	sendClosed bool       // 已经调用了CloseSend
+	trailer    Metadata
+	done       chan struct{} // 流结束时被关闭
+}
+
+// NewStream 调用服务端的流式方法，args为发送给服务端的第一条消息，
+// reply为应答类型的指针（例如new(Reply)），只用于确定如何解码服务端发送的每条消息。
+// 取消ctx或调用Close会通知服务端结束这个流。流式调用不经过Option.Interceptors
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	replyType := reflect.TypeOf(reply)
+	if replyType == nil || replyType.Kind() != reflect.Ptr {
+		return nil, errors.New("rpc client: stream reply must be a pointer")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &ClientStream{
+		client:    client,
+		replyType: replyType,
+		cancel:    cancel,
+		recv:      newStreamQueue(),
+		sendWin:   newSendWindow(),
+		done:      make(chan struct{}),
+	}
+
+	client.sending.Lock()
+	seq, err := client.registerStream(stream)
+	if err == nil {
+		err = client.writeRequest(ctx, seq, serviceMethod, args)
+		if err != nil {
+			client.removeStream(seq)
+			err = sendError(err)
+		}
+	}
+	client.sending.Unlock()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			//流还没有结束，通知服务端放弃它
+			if client.removeStream(seq) != nil {
+				client.sendCancel(seq)
+				stream.finish(errors.New("rpc client: stream canceled: "+ctx.Err().Error()), nil)
+			}
+		case <-stream.done:
+			cancel()
+		}
+	}()
+	return stream, nil
+}
+
+func (client *Client) registerStream(stream *ClientStream) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown {
+		return 0, notSent(ErrShutdown, ErrShutdown)
+	}
+	if client.draining {
+		return 0, notSent(ErrDraining, ErrDraining)
+	}
+	stream.seq = client.seq
+	client.streams[stream.seq] = stream
+	client.seq++
+	return stream.seq, nil
+}
+
+func (client *Client) getStream(seq uint64) *ClientStream {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.streams[seq]
+}
+
+func (client *Client) removeStream(seq uint64) *ClientStream {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	stream := client.streams[seq]
+	delete(client.streams, seq)
+	return stream
+}
+
+// receive 在Client.receive中被调用，处理服务端在这个流上发送的一条消息
+func (s *ClientStream) receive(h *codec.Header) error {
+	switch h.Kind {
+	case codec.KindStream:
+		//服务端没有等待额度，丢弃消息并通知服务端结束这个流
+		if !s.recvWin.receive() {
+			s.client.removeStream(s.seq)
+			s.finish(Errorf(ResourceExhausted, "rpc client: stream window of %d messages exceeded", streamWindow), nil)
+			go s.client.sendCancel(s.seq)
+			return s.client.cc.ReadBody(nil)
+		}
+		v := newMsg(s.replyType)
+		if err := s.client.cc.ReadBody(v.Interface()); err != nil {
+			s.client.removeStream(s.seq)
+			s.finish(&CallError{Class: ErrCodec, Sent: true, Err: errors.New("reading body " + err.Error())}, nil)
+			//分帧传输时消息体已经被完整读出，通知服务端结束这个流，连接仍然可用
+			if errors.As(err, new(*codec.BodyError)) {
+				go s.client.sendCancel(s.seq)
+				return nil
+			}
+			return err
+		}
+		s.recv.push(v)
+		return nil
+	case codec.KindWindow:
+		n, err := readWindow(s.client.cc)
+		if err != nil {
+			return err
+		}
+		s.sendWin.add(n)
+		return nil
+	}
+	//结束消息，或者请求在开始处理前就出错了
+	s.client.removeStream(s.seq)
+	err := io.EOF
+	if h.Error != "" {
+		err = headerError(h)
+	}
+	s.finish(err, h.Metadata)
+	return s.client.cc.ReadBody(nil)
+}
+
+// finish 结束这个流，只有第一次调用生效
+func (s *ClientStream) finish(err error, trailer map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.recv.close(err) {
+		return
+	}
+	s.trailer = trailer
+	close(s.done)
+}
+
+// Send 向服务端发送一条消息，类型需要和服务端方法的参数一致。
+// 服务端读取较慢时会阻塞，流已经结束时返回io.EOF，结束的原因可以通过Recv获得
+func (s *ClientStream) Send(args interface{}) error {
+	s.mu.Lock()
+	closed := s.sendClosed
+	s.mu.Unlock()
+	if closed {
+		return errors.New("rpc client: send on closed stream")
+	}
+	if !s.sendWin.acquire(s.done) {
+		return io.EOF
+	}
+	return s.write(codec.KindStream, args)
+}
+
+// CloseSend 通知服务端不会再发送消息，服务端的Recv会返回io.EOF
+func (s *ClientStream) CloseSend() error {
+	s.mu.Lock()
+	if s.sendClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	s.mu.Unlock()
+	return s.write(codec.KindStreamEnd, invalidRequest)
+}
+
+func (s *ClientStream) write(kind codec.Kind, body interface{}) error {
+	select {
+	case <-s.done:
+		return io.EOF
+	default:
+	}
+	h := &codec.Header{Seq: s.seq, Kind: kind}
+	s.client.sending.Lock()
+	defer s.client.sending.Unlock()
+	return s.client.cc.Encode(h, body)
+}
+
+// Recv 读取服务端发送的下一条消息并写入reply，reply的类型需要和NewStream时的一致。
+// 流正常结束时返回io.EOF，服务端方法返回错误或流被取消时返回对应的错误
+func (s *ClientStream) Recv(reply interface{}) error {
+	v, err := s.recv.pop(nil)
+	if err != nil {
+		return err
+	}
+	if n := s.recvWin.consume(); n > 0 {
+		_ = s.write(codec.KindWindow, uint32(n))
+	}
+	return assignMsg(reply, v)
+}
+
+// CloseAndRecv 用于客户端流：调用CloseSend后读取服务端的应答
+func (s *ClientStream) CloseAndRecv(reply interface{}) error {
+	//流已经结束时，结束的原因由Recv返回
+	if err := s.CloseSend(); err != nil && err != io.EOF {
+		return err
+	}
+	return s.Recv(reply)
+}
+
+// Trailer 返回服务端方法设置的trailer，只有在Recv返回io.EOF或错误后才有效
+func (s *ClientStream) Trailer() Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trailer
+}
+
+// Close 放弃这个流，服务端方法的ctx会被取消
+func (s *ClientStream) Close() error {
+	s.cancel()
+	return nil
+}
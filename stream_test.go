@@ -0,0 +1,274 @@
+package tinyrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"tinyrpc/codec"
+)
+
+// Count sends argv numbers starting from 0, and fails if argv is negative
+func (b Baz) Count(ctx context.Context, argv int, stream ServerStream) error {
+	if argv < 0 {
+		_ = stream.Send(0)
+		return errors.New("negative count")
+	}
+	for i := 0; i < argv; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+	}
+	return SetTrailer(ctx, Metadata{"count": "done"})
+}
+
+// Tail sends a number every 10ms until the stream is canceled
+func (b Baz) Tail(ctx context.Context, argv int, stream ServerStream) error {
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			b.canceled <- ctx.Err()
+			return ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+			_ = stream.Send(i)
+		}
+	}
+}
+
+func TestCreatService_streamMethod(t *testing.T) {
+	s := creatService(Baz{})
+	mType := s.method["Count"]
+	_assert(mType != nil && mType.stream && mType.hasCtx, "Count should be registered as a stream method")
+	_assert(mType.ArgType.Kind().String() == "int" && mType.ReplyType == nil, "unexpected types %v %v", mType.ArgType, mType.ReplyType)
+}
+
+func TestClient_NewStream(t *testing.T) {
+	t.Parallel()
+	addr, canceled := startBazServer(t)
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ})
+			_assert(err == nil, "dial: %v", err)
+			defer func() { _ = client.Close() }()
+
+			stream, err := client.NewStream(context.Background(), "Baz.Count", 100, new(int))
+			_assert(err == nil, "new stream: %v", err)
+			var n int
+			for i := 0; ; i++ {
+				if err = stream.Recv(&n); err != nil {
+					_assert(err == io.EOF && i == 100, "expect EOF after 100 messages, got %v after %d", err, i)
+					break
+				}
+				_assert(n == i, "expect %d, got %d", i, n)
+			}
+			_assert(stream.Trailer()["count"] == "done", "expect trailer, got %v", stream.Trailer())
+
+			stream, _ = client.NewStream(context.Background(), "Baz.Count", -1, new(int))
+			_assert(stream.Recv(&n) == nil && n == 0, "expect the message sent before the error")
+			err = stream.Recv(&n)
+			_assert(err != nil && err.Error() == "negative count", "expect the method error, got %v", err)
+
+			stream, _ = client.NewStream(context.Background(), "Baz.Nope", 1, new(int))
+			err = stream.Recv(&n)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error, got %v", err)
+
+			// the connection is still usable for unary calls
+			err = client.Call(context.Background(), "Baz.Echo", 2, &n)
+			_assert(err == nil && n == 2, "call after stream failed: %v", err)
+		})
+	}
+
+	t.Run("close", func(t *testing.T) {
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "dial: %v", err)
+		defer func() { _ = client.Close() }()
+		stream, err := client.NewStream(context.Background(), "Baz.Tail", 0, new(int))
+		_assert(err == nil, "new stream: %v", err)
+		var n int
+		for i := 0; i < 3; i++ {
+			_assert(stream.Recv(&n) == nil && n == i, "expect %d, got %d", i, n)
+		}
+		_ = stream.Close()
+		_assert(<-canceled == context.Canceled, "server should see the stream canceled")
+	})
+}
+
+// Sum reads numbers until the client closes its side, then replies with the sum
+func (b Baz) Sum(ctx context.Context, argv int, stream ServerStream) error {
+	sum := argv
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return stream.Send(sum)
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+	}
+}
+
+// Double replies to every number with its double
+func (b Baz) Double(argv int, stream ServerStream) error {
+	n := argv
+	for {
+		if err := stream.Send(n * 2); err != nil {
+			return err
+		}
+		if err := stream.Recv(&n); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Flood sends argv numbers and records how many were sent
+func (b Baz) Flood(ctx context.Context, argv int, stream ServerStream) error {
+	for i := 0; i < argv; i++ {
+		if err := stream.Send(i); err != nil {
+			return err
+		}
+		b.sent <- i
+	}
+	return nil
+}
+
+func TestClient_clientStream(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Baz.Sum", 0, new(int))
+	_assert(err == nil, "new stream: %v", err)
+	want := 0
+	for i := 1; i <= 200; i++ {
+		_assert(stream.Send(i) == nil, "send %d", i)
+		want += i
+	}
+	var sum int
+	err = stream.CloseAndRecv(&sum)
+	_assert(err == nil && sum == want, "expect sum %d, got %d %v", want, sum, err)
+	_assert(stream.Recv(&sum) == io.EOF, "expect EOF after the reply")
+}
+
+func TestClient_bidiStream(t *testing.T) {
+	t.Parallel()
+	addr, _ := startBazServer(t)
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Baz.Double", 1, new(int))
+	_assert(err == nil, "new stream: %v", err)
+	var n int
+	_assert(stream.Recv(&n) == nil && n == 2, "expect 2, got %d", n)
+	for i := 2; i < 100; i++ {
+		_assert(stream.Send(i) == nil, "send %d", i)
+		_assert(stream.Recv(&n) == nil && n == i*2, "expect %d, got %d", i*2, n)
+	}
+	_assert(stream.CloseSend() == nil, "close send")
+	_assert(stream.Recv(&n) == io.EOF, "expect EOF")
+}
+
+func TestClient_streamFlowControl(t *testing.T) {
+	t.Parallel()
+	b := Baz{sent: make(chan int, 1000)}
+	server := NewServer()
+	_assert(server.Register(b) == nil, "register Baz")
+	l, _ := net.Listen("tcp", ":0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Baz.Flood", 1000, new(int))
+	_assert(err == nil, "new stream: %v", err)
+	time.Sleep(time.Millisecond * 200)
+	_assert(len(b.sent) == streamWindow, "server should stop after %d messages, sent %d", streamWindow, len(b.sent))
+	var n int
+	for i := 0; i < 1000; i++ {
+		_assert(stream.Recv(&n) == nil && n == i, "expect %d, got %d", i, n)
+	}
+	_assert(stream.Recv(&n) == io.EOF, "expect EOF")
+}
+
+func TestStream_receiveWindow(t *testing.T) {
+	t.Parallel()
+	_, addr, canceled := newBazServer(t)
+
+	//不等待额度的客户端：Tail从不调用Recv，超出窗口后流以ResourceExhausted结束
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_assert(json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType}) == nil, "send option")
+	cc := codec.NewGobCodec(conn)
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Baz.Tail", Seq: 1}, 0) == nil, "send request")
+	for i := 0; i < streamWindow*2; i++ {
+		_assert(cc.Write(&codec.Header{Seq: 1, Kind: codec.KindStream}, i) == nil, "send message %d", i)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	var h codec.Header
+	for h.Kind != codec.KindStreamEnd {
+		h = codec.Header{}
+		_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(nil) == nil, "read reply")
+	}
+	_assert(Code(h.Code) == ResourceExhausted, "expect ResourceExhausted, got %d %q", h.Code, h.Error)
+	_assert(<-canceled == context.Canceled, "expect the method ctx to be canceled")
+
+	//不等待额度的服务端：客户端结束这个流并发送取消消息
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	flooded := make(chan bool, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			flooded <- false
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		dec := json.NewDecoder(conn)
+		var opt Option
+		_ = dec.Decode(&opt)
+		cc := codec.NewGobCodec(newOptionConn(conn, dec))
+		var h codec.Header
+		if cc.ReadHeader(&h) != nil || cc.ReadBody(nil) != nil {
+			flooded <- false
+			return
+		}
+		for i := 0; i < streamWindow*2; i++ {
+			_ = cc.Write(&codec.Header{Seq: h.Seq, Kind: codec.KindStream}, i)
+		}
+		for {
+			var c codec.Header
+			if cc.ReadHeader(&c) != nil || cc.ReadBody(nil) != nil {
+				flooded <- false
+				return
+			}
+			if c.Kind == codec.KindCancel && c.Seq == h.Seq {
+				flooded <- true
+				return
+			}
+		}
+	}()
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	stream, err := client.NewStream(context.Background(), "Baz.Count", 0, new(int))
+	_assert(err == nil, "new stream: %v", err)
+	_assert(<-flooded, "expect the client to cancel the stream")
+	var n int
+	for err == nil {
+		err = stream.Recv(&n)
+	}
+	_assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted, got %v", err)
+}
@@ -0,0 +1,55 @@
+package tinyrpc
+
+//TLS传输：客户端通过Option.TLSConfig或XDial的tls@host:port发起TLS连接，
+//服务端通过AcceptTLS在TLS listener上服务，双向认证时方法可以从ctx中取得对端证书
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+type tlsStateKey struct{}
+
+// AcceptTLS 在lis上接收TLS连接，config中需要设置服务端证书
+//要求客户端证书时设置config.ClientAuth和config.ClientCAs
+func (server *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
+
+// AcceptTLS 默认服务端在lis上接收TLS连接
+func AcceptTLS(lis net.Listener, config *tls.Config) { DefaultServer.AcceptTLS(lis, config) }
+
+// TLSConnectionState 返回处理当前请求的TLS连接的状态，不是TLS连接时返回false
+func TLSConnectionState(ctx context.Context) (*tls.ConnectionState, bool) {
+	state, ok := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state, ok
+}
+
+// PeerCertificate 返回对端经过验证的证书，没有时返回nil
+//服务端只有在config.ClientAuth要求验证客户端证书时才能拿到经过验证的证书
+func PeerCertificate(ctx context.Context) *x509.Certificate {
+	state, ok := TLSConnectionState(ctx)
+	if !ok || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// tlsClient 用config包装conn并完成握手，config没有设置ServerName时使用address中的主机名
+func tlsClient(conn net.Conn, address string, config *tls.Config) (*tls.Conn, error) {
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
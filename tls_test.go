@@ -0,0 +1,133 @@
+package tinyrpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Peer replies with the common name of the verified client certificate
+func (b Baz) Peer(ctx context.Context, argv int, reply *string) error {
+	cert := PeerCertificate(ctx)
+	if cert == nil {
+		return errors.New("no peer certificate")
+	}
+	*reply = cert.Subject.CommonName
+	return nil
+}
+
+// issue creates a certificate signed by parent, or a self-signed CA when parent is nil
+func issue(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "generate key: %v", err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	_assert(err == nil, "create certificate: %v", err)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	ca := issue(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert, clientCert := issue(t, "server", &ca), issue(t, "alice", &ca)
+
+	server := NewServer()
+	_assert(server.Register(Baz{}) == nil, "register Baz")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+
+	config := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}
+	client, err := XDial("tls@"+l.Addr().String(), &Option{TLSConfig: config})
+	_assert(err == nil, "dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Baz.Peer", 1, &reply)
+	_assert(err == nil && reply == "alice", "expect peer alice, got %q %v", reply, err)
+
+	//没有客户端证书或者不信任服务端证书时无法建立连接
+	client, err = Dial("tcp", l.Addr().String(), &Option{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err == nil {
+		err = client.Call(context.Background(), "Baz.Peer", 1, &reply)
+		_ = client.Close()
+	}
+	_assert(err != nil, "expect an error without client certificate")
+	_, err = XDial("tls@" + l.Addr().String())
+	_assert(err != nil, "expect an error for an untrusted server")
+}
+
+func TestAuth_tls(t *testing.T) {
+	t.Parallel()
+	ca := issue(t, "ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := issue(t, "server", &ca)
+
+	server := NewServer(WithAuthenticator(TLSAuthenticator()), WithAuthorizer(ACL{
+		"Baz.Whoami": {"*"},
+		"Baz.*":      {"admin"},
+	}))
+	_assert(server.Register(Baz{}) == nil, "register Baz")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.AcceptTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	})
+
+	call := func(cert *tls.Certificate, serviceMethod string, reply interface{}) error {
+		config := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		client, err := XDial("tls@"+l.Addr().String(), &Option{TLSConfig: config})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = client.Close() }()
+		return client.Call(context.Background(), serviceMethod, 1, reply)
+	}
+	alice, admin := issue(t, "alice", &ca), issue(t, "admin", &ca)
+	var reply string
+	err := call(&alice, "Baz.Whoami", &reply)
+	_assert(err == nil && reply == "alice/tls", "expect alice, got %q %v", reply, err)
+	err = call(&alice, "Baz.Echo", new(int))
+	_assert(CodeOf(err) == PermissionDenied, "expect PermissionDenied, got %v", err)
+	err = call(&admin, "Baz.Echo", new(int))
+	_assert(err == nil, "expect admin to call Echo, got %v", err)
+	//没有客户端证书时认证失败
+	err = call(nil, "Baz.Whoami", &reply)
+	_assert(CodeOf(err) == Unauthenticated, "expect Unauthenticated, got %v", err)
+}
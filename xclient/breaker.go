@@ -0,0 +1,257 @@
+package xclient
+
+//断路器：每个服务端地址一个，连续失败或一段时间内错误率过高时断开，选择服务端时跳过断开的地址；
+//冷却时间过后进入半开状态，放行少量探测调用，探测成功则闭合，失败则重新断开
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	. "tinyrpc"
+)
+
+// ErrCircuitOpen 服务端的断路器处于断开状态，请求没有被发出
+var ErrCircuitOpen = errors.New("rpc xclient: circuit breaker is open")
+
+// BreakerState 断路器的状态
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常放行调用
+	BreakerOpen                         // 拒绝调用，直到冷却时间结束
+	BreakerHalfOpen                     // 放行少量探测调用
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "BreakerState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// BreakerPolicy 断路器的配置，字段为0时使用默认值
+type BreakerPolicy struct {
+	// 连续失败多少次后断开，默认为5
+	ConsecutiveFailures int
+	// Window内的错误率达到ErrorRate且调用数不少于MinRequests时断开，默认为0.5、20次和10s
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// 断开后多久进入半开状态，默认为5s
+	Cooldown time.Duration
+	// 半开状态同时放行的探测调用数，默认为1
+	HalfOpenProbes int
+}
+
+// WithCircuitBreaker 为每个服务端地址开启断路器，配合WithDebugTable可以在调试页面上查看断路器的状态
+func WithCircuitBreaker(p BreakerPolicy) XOption {
+	if p.ConsecutiveFailures <= 0 {
+		p.ConsecutiveFailures = 5
+	}
+	if p.ErrorRate <= 0 {
+		p.ErrorRate = 0.5
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = 20
+	}
+	if p.Window <= 0 {
+		p.Window = time.Second * 10
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = time.Second * 5
+	}
+	if p.HalfOpenProbes <= 0 {
+		p.HalfOpenProbes = 1
+	}
+	return func(xc *XClient) {
+		xc.breakerPolicy = &p
+	}
+}
+
+// WithDebugTable 在调试页面上展示断路器的状态，没有开启断路器时无效
+//调试页面会一直引用XClient，不再使用时必须调用Close把它移除
+func WithDebugTable() XOption {
+	return func(xc *XClient) {
+		xc.debugPage = true
+	}
+}
+
+type breaker struct {
+	*BreakerPolicy
+	mu          sync.Mutex // protect following
+	state       BreakerState
+	consecutive int       // 连续失败的次数
+	windowStart time.Time // 当前统计窗口的开始时间
+	calls       int       // 当前窗口内的调用数
+	failures    int       // 当前窗口内的失败数
+	openedAt    time.Time
+	probes      int    // 半开状态正在进行的探测调用数
+	generation  uint64 // 每次改变状态时加一，用于丢弃上一个状态放行的调用的结果
+}
+
+// ready 判断调用能否发往这个服务端，不占用探测名额，用于选择服务端
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.Cooldown
+	case BreakerHalfOpen:
+		return b.probes < b.HalfOpenProbes
+	}
+	return true
+}
+
+// allow 判断调用能否发出，半开状态时占用一个探测名额
+//返回放行调用时的状态代数，调用结束后传给record
+func (b *breaker) allow() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.Cooldown {
+			return 0, false
+		}
+		b.reset(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.HalfOpenProbes {
+			return 0, false
+		}
+		b.probes++
+	}
+	return b.generation, true
+}
+
+// record 记录一次已放行调用的结果err，generation为allow的返回值
+//调用期间断路器已经改变了状态时丢弃结果：闭合状态放行的慢调用不能关闭或重新断开半开的断路器
+func (b *breaker) record(generation uint64, err error) {
+	failed := breakerFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	if b.state == BreakerHalfOpen {
+		b.probes--
+		switch {
+		case failed:
+			b.open()
+		case responded(err):
+			b.reset(BreakerClosed)
+		}
+		//没有拿到服务端的应答（调用者取消、编解码失败、连接正在排空）不能说明服务端是否恢复，只释放探测名额
+		return
+	}
+	if time.Since(b.windowStart) >= b.Window {
+		b.windowStart, b.calls, b.failures = time.Now(), 0, 0
+	}
+	b.calls++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	if b.consecutive >= b.ConsecutiveFailures ||
+		(b.calls >= b.MinRequests && float64(b.failures) >= b.ErrorRate*float64(b.calls)) {
+		b.open()
+	}
+}
+
+func (b *breaker) open() {
+	b.reset(BreakerOpen)
+	b.openedAt = time.Now()
+}
+
+func (b *breaker) reset(state BreakerState) {
+	b.state = state
+	b.generation++
+	b.consecutive, b.calls, b.failures, b.probes = 0, 0, 0, 0
+	b.windowStart = time.Now()
+}
+
+// breakerFailure 判断err是否说明服务端不健康，业务错误和调用者取消的调用不计入
+func breakerFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrDraining) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var ce *CallError
+	if errors.As(err, &ce) {
+		return ce.Class != context.Canceled && !errors.Is(ce.Class, ErrCodec)
+	}
+	switch CodeOf(err) {
+	case Unavailable, DeadlineExceeded, Internal, ResourceExhausted, DataLoss:
+		return true
+	}
+	return false
+}
+
+// responded 判断调用是否拿到了服务端的应答，包括服务端返回的业务错误
+func responded(err error) bool {
+	return err == nil || errors.As(err, new(*StatusError))
+}
+
+// breaker 返回rpcAddr的断路器，没有开启断路器时返回nil
+func (xc *XClient) breaker(rpcAddr string) *breaker {
+	if xc.breakerPolicy == nil {
+		return nil
+	}
+	b, _ := xc.breakers.LoadOrStore(rpcAddr, &breaker{BreakerPolicy: xc.breakerPolicy, windowStart: time.Now()})
+	return b.(*breaker)
+}
+
+// get 按SelectMode选择一个服务端，跳过断路器断开的服务端；全部断开时返回选出的最后一个
+func (xc *XClient) get(ctx context.Context) (string, error) {
+	switch xc.mode {
+	case ConsistentHashSelect:
+		return xc.getByHash(ctx, nil)
+	case P2CSelect:
+		return xc.getByLoad(ctx, nil)
+	}
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil || xc.breakerPolicy == nil || xc.breaker(rpcAddr).ready() {
+		return rpcAddr, err
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < len(servers); i++ {
+		if rpcAddr, err = xc.d.Get(xc.mode); err != nil || xc.breaker(rpcAddr).ready() {
+			return rpcAddr, err
+		}
+	}
+	for _, s := range servers {
+		if xc.breaker(s).ready() {
+			return s, nil
+		}
+	}
+	return rpcAddr, nil
+}
+
+// debugTable 断路器在调试页面上的表格
+func (xc *XClient) debugTable() DebugTable {
+	t := DebugTable{
+		Title:  fmt.Sprintf("XClient %p circuit breakers", xc),
+		Header: []string{"Server", "State", "Consecutive failures", "Window calls", "Window failures"},
+	}
+	xc.breakers.Range(func(key, value interface{}) bool {
+		b := value.(*breaker)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		t.Rows = append(t.Rows, []string{key.(string), b.state.String(),
+			strconv.Itoa(b.consecutive), strconv.Itoa(b.calls), strconv.Itoa(b.failures)})
+		return true
+	})
+	sort.Slice(t.Rows, func(i, j int) bool { return t.Rows[i][0] < t.Rows[j][0] })
+	return t
+}
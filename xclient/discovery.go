@@ -11,10 +11,20 @@ import (
 type SelectMode int
 
 const (
-	RandomSelect     SelectMode = iota // select randomly
-	RoundRobinSelect                   // select using Robbin algorithm
+	RandomSelect             SelectMode = iota // select randomly
+	RoundRobinSelect                           // select using Robbin algorithm
+	WeightedRandomSelect                       // select randomly in proportion to the weights
+	WeightedRoundRobinSelect                   // select using smooth weighted round-robin algorithm
+	ConsistentHashSelect                       // select by the key of the request on a consistent hash ring, see WithHashKey
+	P2CSelect                                  // select the less loaded of two random servers by in-flight calls and latency
 )
 
+// WeightedServer 带权重的服务端地址，权重小于等于0时按1处理
+type WeightedServer struct {
+	Addr   string
+	Weight int
+}
+
 type Discovery interface {
 	Refresh() error // refresh from remote registry
 	Update(servers []string) error
@@ -30,7 +40,9 @@ type MultiServersDiscovery struct {
 	r       *rand.Rand   // generate random number
 	mu      sync.RWMutex // protect following
 	servers []string
-	index   int // record the selected position for robin algorithm
+	index   int            // record the selected position for robin algorithm
+	weights map[string]int // 服务端的权重，没有记录的为1
+	current map[string]int // 平滑加权轮询中服务端的当前权重
 }
 
 // Refresh doesn't make sense for MultiServersDiscovery, so ignore it
@@ -43,9 +55,39 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.servers = servers
+	d.weights, d.current = nil, nil
+	return nil
+}
+
+// UpdateWeighted 更新服务端列表和它们的权重
+func (d *MultiServersDiscovery) UpdateWeighted(servers []WeightedServer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setWeighted(servers)
 	return nil
 }
 
+// setWeighted 调用者需要持有d.mu，仍在列表中的服务端保留平滑加权轮询的当前权重
+func (d *MultiServersDiscovery) setWeighted(servers []WeightedServer) {
+	current := make(map[string]int, len(servers))
+	d.servers = make([]string, 0, len(servers))
+	d.weights = make(map[string]int, len(servers))
+	for _, s := range servers {
+		d.servers = append(d.servers, s.Addr)
+		d.weights[s.Addr] = s.Weight
+		current[s.Addr] = d.current[s.Addr]
+	}
+	d.current = current
+}
+
+// weight 返回addr的权重，调用者需要持有d.mu
+func (d *MultiServersDiscovery) weight(addr string) int {
+	if w := d.weights[addr]; w > 0 {
+		return w
+	}
+	return 1
+}
+
 // Get a server according to mode
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 	d.mu.Lock()
@@ -61,6 +103,35 @@ func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
 		s := d.servers[d.index%n] // Servers could be updated, so mode n to ensure safety
 		d.index = (d.index + 1) % n
 		return s, nil
+	case WeightedRandomSelect:
+		total := 0
+		for _, s := range d.servers {
+			total += d.weight(s)
+		}
+		x := d.r.Intn(total)
+		for _, s := range d.servers {
+			if x -= d.weight(s); x < 0 {
+				return s, nil
+			}
+		}
+		return d.servers[n-1], nil
+	case WeightedRoundRobinSelect:
+		//平滑加权轮询：每次给所有服务端的当前权重加上它的权重，选当前权重最大的，再减去权重之和
+		//权重为{5, 1, 1}时选择的顺序为a a b a c a a，不会连续选中同一个服务端
+		if d.current == nil {
+			d.current = make(map[string]int, n)
+		}
+		total, best := 0, ""
+		for _, s := range d.servers {
+			w := d.weight(s)
+			d.current[s] += w
+			total += w
+			if best == "" || d.current[s] > d.current[best] {
+				best = s
+			}
+		}
+		d.current[best] -= total
+		return best, nil
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
@@ -85,3 +156,10 @@ func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	d.index = d.r.Intn(math.MaxInt32 - 1)
 	return d
 }
+
+// NewWeightedDiscovery creates a MultiServersDiscovery instance with weighted servers
+func NewWeightedDiscovery(servers []WeightedServer) *MultiServersDiscovery {
+	d := NewMultiServerDiscovery(nil)
+	d.setWeighted(servers)
+	return d
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -44,13 +45,20 @@ func (d *RegistryDiscovery) Refresh() error {
 		return err
 	}
 	servers := strings.Split(resp.Header.Get("X-tinyrpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
+	//权重和服务器按相同的顺序排列，旧版本的注册中心没有权重
+	weights := strings.Split(resp.Header.Get("X-tinyrpc-Weights"), ",")
+	weighted := make([]WeightedServer, 0, len(servers))
+	for i, server := range servers {
 		//取出两端空字符
 		if strings.TrimSpace(server) != "" {
-			d.servers = append(d.servers, strings.TrimSpace(server))
+			s := WeightedServer{Addr: strings.TrimSpace(server)}
+			if i < len(weights) {
+				s.Weight, _ = strconv.Atoi(strings.TrimSpace(weights[i]))
+			}
+			weighted = append(weighted, s)
 		}
 	}
+	d.setWeighted(weighted)
 	d.lastUpdate = time.Now()
 	return nil
 }
@@ -0,0 +1,111 @@
+package xclient
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	. "tinyrpc"
+)
+
+// FailMode 调用失败时XClient的处理方式
+type FailMode int
+
+const (
+	Failfast FailMode = iota // 直接返回错误
+	Failover                 // 按重试策略换一个服务端重试
+	Failtry                  // 按重试策略在同一个服务端上重试
+	Forking                  // 同时调用多个服务端，返回第一个成功的结果
+)
+
+// WithFailMode 设置调用失败时的处理方式
+//没有设置时，配置了重试策略为Failover，否则为Failfast；
+//设置为Failover或Failtry但没有配置重试策略时使用DefaultRetryPolicy
+//Forking只对WithIdempotent标记的方法生效，其他方法按Failfast处理
+func WithFailMode(mode FailMode) XOption {
+	return func(xc *XClient) {
+		xc.failMode = mode
+	}
+}
+
+// WithForks 设置Forking同时调用的服务端数量，默认为2
+func WithForks(n int) XOption {
+	return func(xc *XClient) {
+		xc.forks = n
+	}
+}
+
+// fanOut 在每个服务端上并发调用serviceMethod，firstSuccess为true时任意一个成功即返回，
+//否则全部成功才算成功。结束时取消还没有完成的调用，reply为第一个成功的应答
+//每个调用的trailer先写入各自的md，再合并到调用者WithTrailer提供的md中：
+//firstSuccess为true时只合并第一个成功的调用，否则合并所有成功的调用
+func (xc *XClient) fanOut(ctx context.Context, servers []string, firstSuccess bool, serviceMethod string, args, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex // protect e, failed, succeeded and replyDone
+	var e error
+	failed, succeeded := 0, 0
+	replyDone := reply == nil // if reply is nil, don't need to set value
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			trailer := make(Metadata)
+			err := xc.call(rpcAddr, WithTrailer(ctx, trailer), serviceMethod, args, clonedReply)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				if e == nil {
+					e = err
+				}
+				if !firstSuccess {
+					cancel() // if any call failed, cancel unfinished calls
+				}
+				return
+			}
+			if !firstSuccess || succeeded == 0 {
+				MergeTrailer(ctx, trailer)
+			}
+			succeeded++
+			if !replyDone {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				replyDone = true
+			}
+			if firstSuccess {
+				cancel() // the first success wins, cancel the others
+			}
+		}(rpcAddr)
+	}
+	wg.Wait()
+	if firstSuccess && failed < len(servers) {
+		return nil
+	}
+	return e
+}
+
+// fork 选择forks个不同的服务端同时调用，返回第一个成功的结果
+func (xc *XClient) fork(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	n := xc.forks
+	if n <= 0 {
+		n = 2
+	}
+	tried := make(map[string]bool)
+	var servers []string
+	for i := 0; i < n; i++ {
+		rpcAddr, err := xc.selectUntried(ctx, tried)
+		if err != nil {
+			return err
+		}
+		if tried[rpcAddr] {
+			break // 服务端不足n个
+		}
+		tried[rpcAddr] = true
+		servers = append(servers, rpcAddr)
+	}
+	return xc.fanOut(ctx, servers, true, serviceMethod, args, reply)
+}
@@ -0,0 +1,123 @@
+package xclient
+
+//一致性哈希：用Discovery的服务端列表构建带虚拟节点的哈希环，按请求的键选择服务端，
+//相同的键总是落在同一个服务端上；服务端加入或离开时只有相邻区间的键会换到别的服务端
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultVirtualNodes 每个服务端在哈希环上的默认虚拟节点数
+const defaultVirtualNodes = 160
+
+type hashKey struct{}
+
+// WithHashKey 设置ConsistentHashSelect选择服务端使用的键，例如用户ID
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// HashKeyer 参数实现了HashKeyer且ctx中没有键时，ConsistentHashSelect使用HashKey的返回值作为键
+type HashKeyer interface {
+	HashKey() string
+}
+
+// WithVirtualNodes 设置ConsistentHashSelect中每个服务端的虚拟节点数，默认为160
+//虚拟节点越多，键在服务端之间分布得越均匀
+func WithVirtualNodes(n int) XOption {
+	return func(xc *XClient) {
+		xc.virtualNodes = n
+	}
+}
+
+// withArgsKey ctx中没有键时用args生成键：args实现了HashKeyer时用HashKey，否则用fmt.Sprint格式化args指向的值
+//args内部的指针字段仍然按地址格式化，相同的值也可能得到不同的键，这样的参数应当实现HashKeyer或使用WithHashKey
+func withArgsKey(ctx context.Context, args interface{}) context.Context {
+	if _, ok := ctx.Value(hashKey{}).(string); ok {
+		return ctx
+	}
+	if k, ok := args.(HashKeyer); ok {
+		return WithHashKey(ctx, k.HashKey())
+	}
+	v := reflect.ValueOf(args)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.IsValid() && v.CanInterface() {
+		args = v.Interface()
+	}
+	return WithHashKey(ctx, fmt.Sprint(args))
+}
+
+type hashRing struct {
+	servers string   // 构建哈希环的服务端列表，用于判断列表是否变化
+	hashes  []uint32 // sorted
+	nodes   map[uint32]string
+}
+
+func newHashRing(servers []string, replicas int) *hashRing {
+	r := &hashRing{servers: strings.Join(servers, ","), nodes: make(map[uint32]string)}
+	for _, s := range servers {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + s))
+			if _, ok := r.nodes[h]; !ok {
+				r.nodes[h] = s
+				r.hashes = append(r.hashes, h)
+			}
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get 从key的位置顺时针找到第一个不被skip的服务端，都被skip时返回key所在的服务端
+func (r *hashRing) get(key string, skip func(string) bool) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; i < len(r.hashes); i++ {
+		if s := r.nodes[r.hashes[(idx+i)%len(r.hashes)]]; skip == nil || !skip(s) {
+			return s
+		}
+	}
+	return r.nodes[r.hashes[idx%len(r.hashes)]]
+}
+
+// hashRing 返回当前服务端列表的哈希环，列表没有变化时复用已经构建的
+func (xc *XClient) hashRing() (*hashRing, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("rpc discovery: no available Servers")
+	}
+	xc.ringMu.Lock()
+	defer xc.ringMu.Unlock()
+	if xc.ring == nil || xc.ring.servers != strings.Join(servers, ",") {
+		n := xc.virtualNodes
+		if n <= 0 {
+			n = defaultVirtualNodes
+		}
+		xc.ring = newHashRing(servers, n)
+	}
+	return xc.ring, nil
+}
+
+// getByHash 按ctx中的键在哈希环上选择服务端，跳过tried中的和断路器断开的服务端
+func (xc *XClient) getByHash(ctx context.Context, tried map[string]bool) (string, error) {
+	r, err := xc.hashRing()
+	if err != nil {
+		return "", err
+	}
+	key, _ := ctx.Value(hashKey{}).(string)
+	return r.get(key, func(s string) bool {
+		return tried[s] || (xc.breakerPolicy != nil && !xc.breaker(s).ready())
+	}), nil
+}
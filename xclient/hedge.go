@@ -0,0 +1,145 @@
+package xclient
+
+//对冲请求：调用在Delay内没有返回时，向另一个服务端再发一份，使用最先成功的应答并取消其他调用
+//用于降低只读方法的尾延迟，例如某个服务端因为GC暂停而变慢的情况
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+	. "tinyrpc"
+)
+
+// HedgePolicy 对冲策略
+type HedgePolicy struct {
+	// 发出一份调用后等待多久没有应答就再发一份，通常取p95延迟
+	Delay time.Duration
+	// 最多额外发出的份数，小于等于0时为1
+	MaxHedges int
+	// 对冲请求占调用数的比例上限，取值(0, 1]，小于等于0时为0.1
+	Budget float64
+}
+
+// maxHedgeTokens 对冲预算最多累积的额度，限制长时间空闲后的突发对冲
+const maxHedgeTokens = 10
+
+// hedgeBudget 令牌桶：每次调用存入Budget个令牌，每次对冲取出一个，令牌不足时不对冲
+type hedgeBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func (b *hedgeBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens += b.ratio; b.tokens > maxHedgeTokens {
+		b.tokens = maxHedgeTokens
+	}
+}
+
+func (b *hedgeBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// hedger 一组方法共享的对冲策略和预算
+type hedger struct {
+	HedgePolicy
+	budget hedgeBudget
+}
+
+// WithHedging 为serviceMethods开启对冲，这些方法必须是只读或幂等的，
+//因为同一个调用可能在多个服务端上执行。这些方法共享同一个对冲预算
+func WithHedging(p HedgePolicy, serviceMethods ...string) XOption {
+	if p.MaxHedges <= 0 {
+		p.MaxHedges = 1
+	}
+	if p.Budget <= 0 {
+		p.Budget = 0.1
+	}
+	h := &hedger{HedgePolicy: p, budget: hedgeBudget{ratio: p.Budget}}
+	return func(xc *XClient) {
+		for _, m := range serviceMethods {
+			xc.hedging[m] = h
+		}
+	}
+}
+
+type hedgeResult struct {
+	reply   interface{}
+	trailer Metadata
+	err     error
+}
+
+// hedge 按h的策略调用serviceMethod，返回最先成功的应答，全部失败时返回第一个错误
+//被取消的调用在hedge返回后仍可能收到trailer，所以每个调用写入各自的md，只合并胜出的调用
+func (xc *XClient) hedge(ctx context.Context, h *hedger, serviceMethod string, args, reply interface{}) error {
+	h.budget.deposit()
+	rpcAddr, err := xc.get(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancel the losers
+	results := make(chan hedgeResult, h.MaxHedges+1)
+	send := func(rpcAddr string) {
+		var clonedReply interface{}
+		if reply != nil {
+			clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		trailer := make(Metadata)
+		callCtx := WithTrailer(ctx, trailer)
+		go func() {
+			err := xc.retryDraining(callCtx, rpcAddr, func(rpcAddr string) error {
+				return xc.call(rpcAddr, callCtx, serviceMethod, args, clonedReply)
+			})
+			results <- hedgeResult{reply: clonedReply, trailer: trailer, err: err}
+		}()
+	}
+	tried := map[string]bool{rpcAddr: true}
+	send(rpcAddr)
+	pending, hedges := 1, 0
+	timer := time.NewTimer(h.Delay)
+	defer timer.Stop()
+	var e error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				MergeTrailer(ctx, r.trailer)
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.reply).Elem())
+				}
+				return nil
+			}
+			if e == nil {
+				e = r.err
+			}
+			if pending == 0 {
+				return e
+			}
+		case <-timer.C:
+			if hedges >= h.MaxHedges {
+				continue
+			}
+			next, err := xc.selectUntried(ctx, tried)
+			//没有其他服务端或者预算不足时不再对冲，等待已经发出的调用
+			if err != nil || tried[next] || !h.budget.withdraw() {
+				continue
+			}
+			tried[next] = true
+			send(next)
+			pending++
+			hedges++
+			timer.Reset(h.Delay)
+		}
+	}
+}
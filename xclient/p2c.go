@@ -0,0 +1,126 @@
+package xclient
+
+//P2C（power of two choices）：XClient记录每个服务端正在进行的调用数和按时间衰减的平均延迟（EWMA），
+//每次随机选两个服务端，选负载较低的一个。比随机和轮询更快地避开过载或变慢的服务端
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadDecay EWMA的衰减时间，越久之前的延迟权重越小，空闲的服务端会逐渐被重新尝试
+const loadDecay = time.Second * 10
+
+// failurePenalty 服务端不健康导致的失败按至少这么长的延迟记录，快速失败的服务端不会因为延迟低而被优先选择
+const failurePenalty = time.Second
+
+// defaultLatency 所有服务端都没有延迟记录时使用的延迟估计
+const defaultLatency = time.Millisecond
+
+// serverLoad 一个服务端的负载
+type serverLoad struct {
+	inflight int64      // 正在进行的调用数
+	mu       sync.Mutex // protect following
+	ewma     float64    // 平均延迟，单位ns
+	last     time.Time  // 上一次更新ewma的时间
+}
+
+// observe 用一次调用的延迟更新EWMA
+func (l *serverLoad) observe(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.ewma = float64(rtt)
+	} else {
+		w := math.Exp(-float64(now.Sub(l.last)) / float64(loadDecay))
+		l.ewma = l.ewma*w + float64(rtt)*(1-w)
+	}
+	l.last = now
+}
+
+// latency 返回按上一次更新以来的时间衰减后的平均延迟，没有延迟记录时返回false
+//很久没有被选中的服务端的延迟估计会逐渐降低，从而被重新尝试
+func (l *serverLoad) latency(now time.Time) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		return 0, false
+	}
+	return l.ewma * math.Exp(-float64(now.Sub(l.last))/float64(loadDecay)), true
+}
+
+// score 负载的估计值：平均延迟乘以包括本次调用在内的调用数，越小越好
+//没有延迟记录的服务端使用unknown作为平均延迟，并返回false
+func (l *serverLoad) score(now time.Time, unknown float64) (float64, bool) {
+	ewma, ok := l.latency(now)
+	if !ok {
+		ewma = unknown
+	}
+	return ewma * float64(atomic.LoadInt64(&l.inflight)+1), ok
+}
+
+// load 返回rpcAddr的负载记录
+func (xc *XClient) load(rpcAddr string) *serverLoad {
+	l, _ := xc.loads.LoadOrStore(rpcAddr, new(serverLoad))
+	return l.(*serverLoad)
+}
+
+// getByLoad 从没有尝试过且断路器没有断开的服务端中随机选两个，返回负载较低的一个
+//没有这样的服务端时从所有服务端中选
+func (xc *XClient) getByLoad(ctx context.Context, tried map[string]bool) (string, error) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	candidates := make([]string, 0, len(servers))
+	for _, s := range servers {
+		if !tried[s] && (xc.breakerPolicy == nil || xc.breaker(s).ready()) {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = servers
+	}
+	switch len(candidates) {
+	case 0:
+		return xc.d.Get(RandomSelect) // let discovery report the error
+	case 1:
+		return candidates[0], nil
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	now := time.Now()
+	unknown := xc.averageLatency(servers, now)
+	sa, _ := xc.load(a).score(now, unknown)
+	sb, known := xc.load(b).score(now, unknown)
+	//负载相同时优先尝试没有延迟记录的服务端
+	if sb < sa || sb == sa && !known {
+		return b, nil
+	}
+	return a, nil
+}
+
+// averageLatency 返回servers中有延迟记录的服务端的平均延迟，作为新服务端的延迟估计
+func (xc *XClient) averageLatency(servers []string, now time.Time) float64 {
+	var sum float64
+	n := 0
+	for _, s := range servers {
+		if ewma, ok := xc.load(s).latency(now); ok {
+			sum += ewma
+			n++
+		}
+	}
+	if n == 0 {
+		return float64(defaultLatency)
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,196 @@
+package xclient
+
+//XClient的重试：调用失败且错误可以重试时，等待一段指数增长并带有抖动的时间后换一个服务端再试
+//只有标记为幂等的方法才会在请求可能已经执行后重试，其他方法只在请求确定没有执行时重试
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+	. "tinyrpc"
+)
+
+// RetryPolicy 重试策略，等待时间的字段为0时使用默认值
+type RetryPolicy struct {
+	// 最多尝试的次数，包括第一次，小于等于1表示不重试
+	MaxAttempts int
+	// 第一次重试前的等待时间，之后每次乘以Multiplier，不超过MaxBackoff，默认为50ms、2和1s
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// 等待时间随机浮动的比例，取值[0, 1]，避免大量客户端同时重试
+	Jitter float64
+	// 幂等方法收到这些错误码时重试，为nil时使用Unavailable和DeadlineExceeded
+	RetryableCodes []Code
+}
+
+// DefaultRetryPolicy 默认的重试策略
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond * 50,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// XOption XClient的可选配置
+type XOption func(*XClient)
+
+// WithRetryPolicy 设置所有方法的重试策略
+func WithRetryPolicy(p RetryPolicy) XOption {
+	return func(xc *XClient) {
+		xc.retry = &p
+	}
+}
+
+// WithMethodRetryPolicy 为serviceMethod单独设置重试策略
+func WithMethodRetryPolicy(serviceMethod string, p RetryPolicy) XOption {
+	return func(xc *XClient) {
+		xc.methodRetry[serviceMethod] = &p
+	}
+}
+
+// WithIdempotent 把方法标记为幂等，幂等的方法在请求可能已经执行后也可以重试
+func WithIdempotent(serviceMethods ...string) XOption {
+	return func(xc *XClient) {
+		for _, m := range serviceMethods {
+			xc.idempotent[m] = true
+		}
+	}
+}
+
+// retryPolicy 返回serviceMethod使用的重试策略，没有设置时返回DefaultRetryPolicy
+func (xc *XClient) retryPolicy(serviceMethod string) *RetryPolicy {
+	if p, ok := xc.methodRetry[serviceMethod]; ok {
+		return p
+	}
+	if xc.retry != nil {
+		return xc.retry
+	}
+	return &DefaultRetryPolicy
+}
+
+// retryable 判断err是否可以重试
+func (p *RetryPolicy) retryable(err error, idempotent bool) bool {
+	//请求确定没有被执行，任何方法都可以重试
+	if SafeToRetry(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	var ce *CallError
+	if errors.As(err, &ce) {
+		//调用者的ctx结束时不再重试，应答无法解码时重试也不会成功
+		return errors.Is(ce.Class, ErrConnectionLost)
+	}
+	codes := p.RetryableCodes
+	if codes == nil {
+		codes = []Code{Unavailable, DeadlineExceeded}
+	}
+	code := CodeOf(err)
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 返回第attempt次重试前的等待时间，attempt从1开始
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d, max, multiplier := float64(p.InitialBackoff), float64(p.MaxBackoff), p.Multiplier
+	if d <= 0 {
+		d = float64(time.Millisecond * 50)
+	}
+	if max <= 0 {
+		max = float64(time.Second)
+	}
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= multiplier
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// wait 等待d，ctx结束或剩余时间不足d时返回false
+func wait(ctx context.Context, d time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// selectUntried 选择一个还没有尝试过的服务端，都尝试过时返回任意一个
+func (xc *XClient) selectUntried(ctx context.Context, tried map[string]bool) (string, error) {
+	switch xc.mode {
+	case ConsistentHashSelect:
+		return xc.getByHash(ctx, tried)
+	case P2CSelect:
+		return xc.getByLoad(ctx, tried)
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var rpcAddr string
+	for i := 0; i <= len(servers); i++ {
+		if rpcAddr, err = xc.get(ctx); err != nil || !tried[rpcAddr] {
+			return rpcAddr, err
+		}
+	}
+	for _, s := range servers {
+		if !tried[s] {
+			return s, nil
+		}
+	}
+	return rpcAddr, nil
+}
+
+// withRetry 按FailMode和serviceMethod的重试策略在选出的服务端上执行f
+func (xc *XClient) withRetry(ctx context.Context, serviceMethod string, f func(rpcAddr string) error) error {
+	p := xc.retryPolicy(serviceMethod)
+	rpcAddr, err := xc.get(ctx)
+	if err != nil {
+		return err
+	}
+	if (xc.failMode != Failover && xc.failMode != Failtry) || p.MaxAttempts <= 1 {
+		return xc.retryDraining(ctx, rpcAddr, f)
+	}
+	tried := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		tried[rpcAddr] = true
+		err = f(rpcAddr)
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(err, xc.idempotent[serviceMethod]) {
+			return err
+		}
+		if !wait(ctx, p.backoff(attempt)) {
+			return err
+		}
+		//Failtry在同一个服务端上重试，但服务端正在关闭时只能换一个
+		if xc.failMode == Failtry && !errors.Is(err, ErrDraining) {
+			continue
+		}
+		next, serr := xc.selectUntried(ctx, tried)
+		if serr != nil {
+			return err
+		}
+		rpcAddr = next
+	}
+}
@@ -2,28 +2,69 @@ package xclient
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 	. "tinyrpc"
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex // protect following
-	clients map[string]*Client
+	d             Discovery
+	mode          SelectMode
+	opt           *Option
+	retry         *RetryPolicy            // 所有方法的重试策略
+	methodRetry   map[string]*RetryPolicy // 单独设置的方法的重试策略
+	idempotent    map[string]bool         // 标记为幂等的方法
+	failMode      FailMode                // 调用失败时的处理方式
+	forks         int                     // Forking同时调用的服务端数量
+	hedging       map[string]*hedger      // 开启了对冲的方法
+	breakerPolicy *BreakerPolicy          // 为nil时不使用断路器
+	breakers      sync.Map                // rpcAddr -> *breaker
+	debugPage     bool                    // 断路器的状态是否展示在调试页面上
+	virtualNodes  int                     // ConsistentHashSelect中每个服务端的虚拟节点数
+	ringMu        sync.Mutex              // protect ring
+	ring          *hashRing               // 服务端列表变化时重建
+	loads         sync.Map                // rpcAddr -> *serverLoad，P2CSelect使用
+	mu            sync.Mutex              // protect following
+	clients       map[string]*Client
 }
 
 var _ io.Closer = (*XClient)(nil)
 
-func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients: make(map[string]*Client)}
+// NewXClient 创建一个XClient，不再使用时需要调用Close关闭到各个服务端的连接（开启WithDebugTable时还会把它从调试页面上移除）
+func NewXClient(d Discovery, mode SelectMode, opt *Option, opts ...XOption) *XClient {
+	xc := &XClient{
+		d:           d,
+		mode:        mode,
+		opt:         opt,
+		methodRetry: make(map[string]*RetryPolicy),
+		idempotent:  make(map[string]bool),
+		hedging:     make(map[string]*hedger),
+		clients:     make(map[string]*Client),
+		failMode:    -1,
+	}
+	for _, o := range opts {
+		o(xc)
+	}
+	if xc.failMode == -1 {
+		xc.failMode = Failfast
+		if xc.retry != nil || len(xc.methodRetry) > 0 {
+			xc.failMode = Failover
+		}
+	}
+	if xc.debugPage && xc.breakerPolicy != nil {
+		RegisterDebugTable(fmt.Sprintf("xclient-%p", xc), xc.debugTable)
+	}
+	return xc
 }
 
 func (xc *XClient) Close() error {
+	if xc.debugPage && xc.breakerPolicy != nil {
+		RegisterDebugTable(fmt.Sprintf("xclient-%p", xc), nil)
+	}
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	for key, client := range xc.clients {
@@ -38,6 +79,10 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	client, ok := xc.clients[rpcAddr]
+	//服务端正在关闭，连接会在已发出的调用完成后由服务端关闭，这里不能主动关闭它
+	if ok && client.IsDraining() {
+		return nil, &CallError{Class: ErrDraining, Err: ErrDraining}
+	}
 	if ok && !client.IsAvailable() {
 		_ = client.Close()
 		delete(xc.clients, rpcAddr)
@@ -55,24 +100,102 @@ func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	b := xc.breaker(rpcAddr)
+	var generation uint64
+	if b != nil {
+		var ok bool
+		if generation, ok = b.allow(); !ok {
+			return &CallError{Class: ErrCircuitOpen, Err: fmt.Errorf("%w: %s", ErrCircuitOpen, rpcAddr)}
+		}
+	}
 	client, err := xc.dial(rpcAddr)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	if err == nil {
+		err = xc.callWithLoad(client, rpcAddr, ctx, serviceMethod, args, reply)
+	} else if xc.mode == P2CSelect && breakerFailure(err) {
+		xc.load(rpcAddr).observe(failurePenalty)
+	}
+	if b != nil {
+		b.record(generation, err)
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	return err
+}
+
+// callWithLoad 使用P2CSelect时记录调用期间服务端的负载和调用的延迟
+func (xc *XClient) callWithLoad(client *Client, rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	if xc.mode != P2CSelect {
+		return client.Call(ctx, serviceMethod, args, reply)
+	}
+	l := xc.load(rpcAddr)
+	atomic.AddInt64(&l.inflight, 1)
+	start := time.Now()
+	err := client.Call(ctx, serviceMethod, args, reply)
+	atomic.AddInt64(&l.inflight, -1)
+	rtt := time.Since(start)
+	switch {
+	case errors.Is(err, context.Canceled):
+		//调用者取消的调用没有完整的延迟
+	case breakerFailure(err) && rtt < failurePenalty:
+		l.observe(failurePenalty)
+	default:
+		l.observe(rtt)
+	}
+	return err
 }
 
 // Call invokes the named function, waits for it to complete,
 // and returns its error status.
-// xc will choose a proper server.
+// xc will choose a proper server, and handle failures according to the fail mode.
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
-	fmt.Println(rpcAddr)
+	if xc.mode == ConsistentHashSelect {
+		ctx = withArgsKey(ctx, args)
+	}
+	if h, ok := xc.hedging[serviceMethod]; ok {
+		return xc.hedge(ctx, h, serviceMethod, args, reply)
+	}
+	if xc.failMode == Forking && xc.idempotent[serviceMethod] {
+		return xc.fork(ctx, serviceMethod, args, reply)
+	}
+	return xc.withRetry(ctx, serviceMethod, func(rpcAddr string) error {
+		return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	})
+}
+
+// retryDraining 在rpcAddr上执行f，如果选中的服务端正在关闭，请求没有被发出，换一个服务端再试
+func (xc *XClient) retryDraining(ctx context.Context, rpcAddr string, f func(rpcAddr string) error) error {
+	err := f(rpcAddr)
+	if errors.Is(err, ErrDraining) {
+		servers, _ := xc.d.GetAll()
+		tried := map[string]bool{rpcAddr: true}
+		for i := 0; i < len(servers) && errors.Is(err, ErrDraining); i++ {
+			if rpcAddr, err = xc.selectUntried(ctx, tried); err != nil {
+				return err
+			}
+			tried[rpcAddr] = true
+			err = f(rpcAddr)
+		}
+	}
+	return err
+}
+
+// NewStream 选择一个服务端并在它上面建立流，流的所有消息都发往这个服务端
+func (xc *XClient) NewStream(ctx context.Context, serviceMethod string, args, reply interface{}) (*ClientStream, error) {
+	if xc.mode == ConsistentHashSelect {
+		ctx = withArgsKey(ctx, args)
+	}
+	rpcAddr, err := xc.get(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+	var stream *ClientStream
+	err = xc.retryDraining(ctx, rpcAddr, func(rpcAddr string) error {
+		client, err := xc.dial(rpcAddr)
+		if err != nil {
+			return err
+		}
+		stream, err = client.NewStream(ctx, serviceMethod, args, reply)
+		return err
+	})
+	return stream, err
 }
 
 // Broadcast invokes the named function for every server registered in discovery
@@ -81,32 +204,5 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	if err != nil {
 		return err
 	}
-	var wg sync.WaitGroup
-	var mu sync.Mutex // protect e and replyDone
-	var e error
-	replyDone := reply == nil // if reply is nil, don't need to set value
-	ctx, cancel := context.WithCancel(ctx)
-	for _, rpcAddr := range servers {
-		wg.Add(1)
-		go func(rpcAddr string) {
-			defer wg.Done()
-			var clonedReply interface{}
-			if reply != nil {
-				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
-			}
-			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
-			mu.Lock()
-			if err != nil && e == nil {
-				e = err
-				cancel() // if any call failed, cancel unfinished calls
-			}
-			if err == nil && !replyDone {
-				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
-				replyDone = true
-			}
-			mu.Unlock()
-		}(rpcAddr)
-	}
-	wg.Wait()
-	return e
+	return xc.fanOut(ctx, servers, false, serviceMethod, args, reply)
 }
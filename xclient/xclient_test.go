@@ -0,0 +1,476 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	. "tinyrpc"
+	"tinyrpc/registry"
+)
+
+// Foo answers Foo.Get after delay with the configured error code, or with argv when code is OK
+type Foo struct {
+	name  string
+	code  Code
+	delay time.Duration
+	calls *int32
+}
+
+func (f Foo) Get(argv int, reply *int) error {
+	atomic.AddInt32(f.calls, 1)
+	time.Sleep(f.delay)
+	if f.code != OK {
+		return Errorf(f.code, "foo failed with %s", f.code)
+	}
+	*reply = argv
+	return nil
+}
+
+// Trailer answers with argv and sets the trailer "from-<name>"
+func (f Foo) Trailer(ctx context.Context, argv int, reply *int) error {
+	*reply = argv
+	return SetTrailer(ctx, Metadata{"from-" + f.name: strconv.Itoa(argv)})
+}
+
+func startFoo(t *testing.T, code Code) (string, *int32) {
+	calls := new(int32)
+	return serveFoo(t, Foo{code: code, calls: calls}), calls
+}
+
+func serveFoo(t *testing.T, foo Foo) string {
+	server := NewServer()
+	if err := server.Register(foo); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	t.Cleanup(func() { _ = l.Close() })
+	return "tcp@" + l.Addr().String()
+}
+
+func TestXClient_retry(t *testing.T) {
+	bad, badCalls := startFoo(t, Internal)
+	good, _ := startFoo(t, OK)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2, Jitter: 0.5}
+
+	t.Run("idempotent", func(t *testing.T) {
+		d := NewMultiServerDiscovery([]string{bad, good})
+		xc := NewXClient(d, RoundRobinSelect, nil, WithRetryPolicy(RetryPolicy{
+			MaxAttempts: 3, InitialBackoff: time.Millisecond, RetryableCodes: []Code{Internal},
+		}), WithIdempotent("Foo.Get"))
+		defer func() { _ = xc.Close() }()
+		for i := 0; i < 4; i++ {
+			var reply int
+			err := xc.Call(context.Background(), "Foo.Get", i, &reply)
+			if err != nil || reply != i {
+				t.Fatalf("expect %d, got %d %v", i, reply, err)
+			}
+		}
+	})
+	t.Run("not idempotent", func(t *testing.T) {
+		atomic.StoreInt32(badCalls, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, nil, WithRetryPolicy(policy))
+		defer func() { _ = xc.Close() }()
+		err := xc.Call(context.Background(), "Foo.Get", 1, new(int))
+		if !errors.Is(err, Internal) || atomic.LoadInt32(badCalls) != 1 {
+			t.Fatalf("expect a single Internal failure, got %v after %d calls", err, atomic.LoadInt32(badCalls))
+		}
+	})
+	t.Run("not idempotent unavailable", func(t *testing.T) {
+		//方法自己返回的Unavailable不能说明请求没有执行
+		unavailable, calls := startFoo(t, Unavailable)
+		xc := NewXClient(NewMultiServerDiscovery([]string{unavailable}), RandomSelect, nil, WithRetryPolicy(policy))
+		defer func() { _ = xc.Close() }()
+		err := xc.Call(context.Background(), "Foo.Get", 1, new(int))
+		if !errors.Is(err, Unavailable) || atomic.LoadInt32(calls) != 1 {
+			t.Fatalf("expect a single Unavailable failure, got %v after %d calls", err, atomic.LoadInt32(calls))
+		}
+	})
+	t.Run("not sent", func(t *testing.T) {
+		//连接失败的请求没有发出，非幂等的方法也会换一个服务端重试
+		d := NewMultiServerDiscovery([]string{"tcp@127.0.0.1:1", good})
+		xc := NewXClient(d, RoundRobinSelect, nil, WithMethodRetryPolicy("Foo.Get", policy))
+		defer func() { _ = xc.Close() }()
+		for i := 0; i < 4; i++ {
+			if err := xc.Call(context.Background(), "Foo.Get", i, new(int)); err != nil {
+				t.Fatalf("expect a retry on the good server, got %v", err)
+			}
+		}
+	})
+	t.Run("deadline", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, nil, WithRetryPolicy(RetryPolicy{
+			MaxAttempts: 10, InitialBackoff: time.Second, RetryableCodes: []Code{Internal},
+		}), WithIdempotent("Foo.Get"))
+		defer func() { _ = xc.Close() }()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		start := time.Now()
+		err := xc.Call(ctx, "Foo.Get", 1, new(int))
+		if !errors.Is(err, Internal) || time.Since(start) > time.Millisecond*150 {
+			t.Fatalf("expect to give up before the deadline, got %v after %s", err, time.Since(start))
+		}
+	})
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	//为0的字段使用默认值：50ms起，每次翻倍，不超过1s
+	var p RetryPolicy
+	for _, c := range []struct {
+		attempt int
+		want    time.Duration
+	}{{1, time.Millisecond * 50}, {2, time.Millisecond * 100}, {6, time.Second}, {20, time.Second}} {
+		if d := p.backoff(c.attempt); d != c.want {
+			t.Fatalf("attempt %d: expect %s, got %s", c.attempt, c.want, d)
+		}
+	}
+	p = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 5, Multiplier: 3}
+	if d := p.backoff(2); d != time.Millisecond*3 {
+		t.Fatalf("expect 3ms, got %s", d)
+	}
+	if d := p.backoff(3); d != time.Millisecond*5 {
+		t.Fatalf("expect 5ms, got %s", d)
+	}
+}
+
+func TestXClient_failMode(t *testing.T) {
+	bad, badCalls := startFoo(t, Internal)
+	good, _ := startFoo(t, OK)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, RetryableCodes: []Code{Internal}}
+
+	t.Run("failfast", func(t *testing.T) {
+		atomic.StoreInt32(badCalls, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, nil,
+			WithRetryPolicy(policy), WithIdempotent("Foo.Get"), WithFailMode(Failfast))
+		defer func() { _ = xc.Close() }()
+		err := xc.Call(context.Background(), "Foo.Get", 1, new(int))
+		if !errors.Is(err, Internal) || atomic.LoadInt32(badCalls) != 1 {
+			t.Fatalf("expect a single Internal failure, got %v after %d calls", err, atomic.LoadInt32(badCalls))
+		}
+	})
+	t.Run("failtry", func(t *testing.T) {
+		//在同一个服务端上重试，不会换到good
+		atomic.StoreInt32(badCalls, 0)
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad, good}), RoundRobinSelect, nil,
+			WithRetryPolicy(policy), WithIdempotent("Foo.Get"), WithFailMode(Failtry))
+		defer func() { _ = xc.Close() }()
+		failed := 0
+		for i := 0; i < 2; i++ {
+			if err := xc.Call(context.Background(), "Foo.Get", i, new(int)); err != nil {
+				failed++
+			}
+		}
+		if failed != 1 || atomic.LoadInt32(badCalls) != 3 {
+			t.Fatalf("expect 1 failure after 3 tries, got %d failures after %d calls", failed, atomic.LoadInt32(badCalls))
+		}
+	})
+	t.Run("forking", func(t *testing.T) {
+		xc := NewXClient(NewMultiServerDiscovery([]string{bad, good}), RandomSelect, nil,
+			WithIdempotent("Foo.Get"), WithFailMode(Forking))
+		defer func() { _ = xc.Close() }()
+		for i := 0; i < 4; i++ {
+			var reply int
+			if err := xc.Call(context.Background(), "Foo.Get", i, &reply); err != nil || reply != i {
+				t.Fatalf("expect %d, got %d %v", i, reply, err)
+			}
+		}
+		//只有一个服务端时返回它的错误
+		xc = NewXClient(NewMultiServerDiscovery([]string{bad}), RandomSelect, nil,
+			WithIdempotent("Foo.Get"), WithFailMode(Forking), WithForks(3))
+		defer func() { _ = xc.Close() }()
+		if err := xc.Call(context.Background(), "Foo.Get", 1, new(int)); !errors.Is(err, Internal) {
+			t.Fatalf("expect Internal, got %v", err)
+		}
+	})
+}
+
+func TestXClient_hedging(t *testing.T) {
+	slow := serveFoo(t, Foo{delay: time.Second, calls: new(int32)})
+	fast := serveFoo(t, Foo{calls: new(int32)})
+	call := func(xc *XClient) time.Duration {
+		var slowest time.Duration
+		for i := 0; i < 2; i++ {
+			start := time.Now()
+			var reply int
+			if err := xc.Call(context.Background(), "Foo.Get", i, &reply); err != nil || reply != i {
+				t.Fatalf("expect %d, got %d %v", i, reply, err)
+			}
+			if d := time.Since(start); d > slowest {
+				slowest = d
+			}
+		}
+		return slowest
+	}
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{slow, fast}), RoundRobinSelect, nil,
+		WithHedging(HedgePolicy{Delay: time.Millisecond * 20, Budget: 1}, "Foo.Get"))
+	defer func() { _ = xc.Close() }()
+	if d := call(xc); d > time.Millisecond*500 {
+		t.Fatalf("expect the hedge to win, the slowest call took %s", d)
+	}
+
+	//预算不足时不对冲
+	xc = NewXClient(NewMultiServerDiscovery([]string{slow, fast}), RoundRobinSelect, nil,
+		WithHedging(HedgePolicy{Delay: time.Millisecond * 20, Budget: 0.1}, "Foo.Get"))
+	defer func() { _ = xc.Close() }()
+	if d := call(xc); d < time.Second {
+		t.Fatalf("expect no hedge without budget, the slowest call took %s", d)
+	}
+}
+
+func TestXClient_circuitBreaker(t *testing.T) {
+	bad, badCalls := startFoo(t, Internal)
+	good, _ := startFoo(t, OK)
+	xc := NewXClient(NewMultiServerDiscovery([]string{bad, good}), RoundRobinSelect, nil,
+		WithCircuitBreaker(BreakerPolicy{ConsecutiveFailures: 2, Cooldown: time.Millisecond * 200}))
+	defer func() { _ = xc.Close() }()
+	call := func(n int) (failed int) {
+		for i := 0; i < n; i++ {
+			if err := xc.Call(context.Background(), "Foo.Get", i, new(int)); err != nil {
+				failed++
+			}
+		}
+		return
+	}
+
+	//断开后不再选择bad
+	call(4)
+	if s := xc.breaker(bad).state; s != BreakerOpen || atomic.LoadInt32(badCalls) != 2 {
+		t.Fatalf("expect the breaker to open after 2 failures, got %s after %d calls", s, atomic.LoadInt32(badCalls))
+	}
+	if failed := call(4); failed != 0 || atomic.LoadInt32(badCalls) != 2 {
+		t.Fatalf("expect bad to be skipped, got %d failures and %d calls", failed, atomic.LoadInt32(badCalls))
+	}
+	if rows := xc.debugTable().Rows; len(rows) != 2 || rows[0][1] != BreakerOpen.String() && rows[1][1] != BreakerOpen.String() {
+		t.Fatalf("expect the open breaker on the debug page, got %v", rows)
+	}
+
+	//冷却后放行一次探测，探测失败重新断开
+	time.Sleep(time.Millisecond * 250)
+	call(4)
+	if s := xc.breaker(bad).state; s != BreakerOpen || atomic.LoadInt32(badCalls) != 3 {
+		t.Fatalf("expect a single failed probe, got %s after %d calls", s, atomic.LoadInt32(badCalls))
+	}
+
+	//闭合时放行的调用在断路器断开并进入半开状态后才结束，它的结果不影响探测
+	b := &breaker{BreakerPolicy: xc.breakerPolicy}
+	slow, _ := b.allow()
+	b.open()
+	b.openedAt = time.Now().Add(-time.Second)
+	probe, ok := b.allow()
+	if _, again := b.allow(); !ok || again {
+		t.Fatal("expect a single probe in half-open state")
+	}
+	if b.record(slow, nil); b.state != BreakerHalfOpen || b.probes != 1 {
+		t.Fatalf("expect a stale result to be ignored, got %s with %d probes", b.state, b.probes)
+	}
+	//探测被调用者取消时只释放名额，不改变状态
+	canceled := &CallError{Class: context.Canceled, Sent: true, Err: context.Canceled}
+	if b.record(probe, canceled); b.state != BreakerHalfOpen || b.probes != 0 {
+		t.Fatalf("expect a canceled probe to free its slot, got %s with %d probes", b.state, b.probes)
+	}
+	//探测成功时闭合
+	probe, _ = b.allow()
+	if b.record(probe, nil); b.state != BreakerClosed {
+		t.Fatalf("expect a successful probe to close the breaker, got %s", b.state)
+	}
+	if b.record(probe, Errorf(Internal, "bad")); b.consecutive != 0 {
+		t.Fatalf("expect the probe result to be recorded once, got %d failures", b.consecutive)
+	}
+}
+
+func TestMultiServersDiscovery_weighted(t *testing.T) {
+	d := NewWeightedDiscovery([]WeightedServer{{Addr: "a", Weight: 5}, {Addr: "b", Weight: 1}, {Addr: "c"}})
+	var seq string
+	for i := 0; i < 7; i++ {
+		s, _ := d.Get(WeightedRoundRobinSelect)
+		seq += s
+	}
+	if seq != "aabacaa" {
+		t.Fatalf("expect smooth weighted round-robin aabacaa, got %s", seq)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 7000; i++ {
+		s, _ := d.Get(WeightedRandomSelect)
+		counts[s]++
+	}
+	if counts["a"] < 4500 || counts["a"] > 5500 || counts["b"] < 700 || counts["c"] < 700 {
+		t.Fatalf("expect picks in proportion to 5:1:1, got %v", counts)
+	}
+
+	//权重来自注册中心的心跳
+	reg := httptest.NewServer(registry.New(0))
+	defer reg.Close()
+	registry.HeartbeatWithWeight(reg.URL, "tcp@big", 3, time.Hour)
+	registry.Heartbeat(reg.URL, "tcp@small", time.Hour)
+	rd := NewRegistryDiscovery(reg.URL, 0)
+	counts = make(map[string]int)
+	for i := 0; i < 8; i++ {
+		s, err := rd.Get(WeightedRoundRobinSelect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[s]++
+	}
+	if counts["tcp@big"] != 6 || counts["tcp@small"] != 2 {
+		t.Fatalf("expect picks in proportion to 3:1, got %v", counts)
+	}
+}
+
+type userArgs struct{ User string }
+
+func (a userArgs) HashKey() string { return a.User }
+
+func TestXClient_consistentHash(t *testing.T) {
+	servers := []string{"tcp@a", "tcp@b", "tcp@c", "tcp@d"}
+	d := NewMultiServerDiscovery(servers)
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	pick := func(ctx context.Context) string {
+		s, err := xc.get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		before[key] = pick(WithHashKey(context.Background(), key))
+		if s := pick(withArgsKey(context.Background(), userArgs{User: key})); s != before[key] {
+			t.Fatalf("expect the args key to route like the ctx key, got %s and %s", s, before[key])
+		}
+	}
+	//指针参数按指向的值生成键，而不是按地址
+	argsKey := func(args interface{}) string {
+		return withArgsKey(context.Background(), args).Value(hashKey{}).(string)
+	}
+	n1, n2 := 42, 42
+	if k1, k2 := argsKey(&n1), argsKey(&n2); k1 != "42" || k2 != "42" {
+		t.Fatalf("expect pointers to equal values to share a key, got %q and %q", k1, k2)
+	}
+	type plainArgs struct{ User string }
+	if k1, k2 := argsKey(plainArgs{"alice"}), argsKey(&plainArgs{"alice"}); k1 != k2 {
+		t.Fatalf("expect a pointer to route like its value, got %q and %q", k2, k1)
+	}
+
+	//加入一个服务端只会把约1/5的键换到新服务端上，其他键不变
+	_ = d.Update(append(servers, "tcp@e"))
+	moved := 0
+	for key, s := range before {
+		if now := pick(WithHashKey(context.Background(), key)); now != s {
+			if now != "tcp@e" {
+				t.Fatalf("expect %s to stay on %s or move to tcp@e, got %s", key, s, now)
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Fatalf("expect about 200 keys to move, got %d", moved)
+	}
+
+	//真实调用按键路由，同一个键的调用落在同一个服务端上
+	var calls [2]*int32
+	var addrs []string
+	for i := range calls {
+		calls[i] = new(int32)
+		addrs = append(addrs, serveFoo(t, Foo{calls: calls[i]}))
+	}
+	xc = NewXClient(NewMultiServerDiscovery(addrs), ConsistentHashSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 10; i++ {
+		if err := xc.Call(WithHashKey(context.Background(), "alice"), "Foo.Get", i, new(int)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n0, n1 := atomic.LoadInt32(calls[0]), atomic.LoadInt32(calls[1]); n0*n1 != 0 || n0+n1 != 10 {
+		t.Fatalf("expect all calls on one server, got %d and %d", n0, n1)
+	}
+}
+
+func TestXClient_p2c(t *testing.T) {
+	slowCalls, fastCalls := new(int32), new(int32)
+	slow := serveFoo(t, Foo{delay: time.Millisecond * 50, calls: slowCalls})
+	fast := serveFoo(t, Foo{calls: fastCalls})
+	xc := NewXClient(NewMultiServerDiscovery([]string{slow, fast}), P2CSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 20; i++ {
+		if err := xc.Call(context.Background(), "Foo.Get", i, new(int)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(slowCalls); n > 2 {
+		t.Fatalf("expect the slow server to be avoided, got %d of 20 calls", n)
+	}
+
+	//延迟相同时选择正在进行的调用较少的服务端
+	xc.loads.Store(slow, &serverLoad{ewma: float64(time.Millisecond), last: time.Now()})
+	xc.loads.Store(fast, &serverLoad{ewma: float64(time.Millisecond), last: time.Now(), inflight: 3})
+	if s, _ := xc.get(context.Background()); s != slow {
+		t.Fatalf("expect the server with fewer in-flight calls, got %s", s)
+	}
+	//没有延迟记录的服务端使用其他服务端的平均延迟，正在进行的调用数仍然有效
+	xc.loads.Store(fast, &serverLoad{inflight: 3})
+	if s, _ := xc.get(context.Background()); s != slow {
+		t.Fatalf("expect a new server with in-flight calls to be avoided, got %s", s)
+	}
+	//很久没有更新的延迟会衰减，变慢过的服务端会被重新尝试
+	xc.loads.Store(slow, &serverLoad{ewma: float64(time.Millisecond * 50), last: time.Now().Add(-time.Minute)})
+	xc.loads.Store(fast, &serverLoad{ewma: float64(time.Millisecond), last: time.Now()})
+	if s, _ := xc.get(context.Background()); s != slow {
+		t.Fatalf("expect the stale latency to decay, got %s", s)
+	}
+
+	//快速失败的服务端按failurePenalty记录延迟，不会因为失败得快而被优先选择
+	bad, badCalls := startFoo(t, Internal)
+	ok := serveFoo(t, Foo{delay: time.Millisecond * 5, calls: new(int32)})
+	xc = NewXClient(NewMultiServerDiscovery([]string{bad, ok}), P2CSelect, nil)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 20; i++ {
+		_ = xc.Call(context.Background(), "Foo.Get", i, new(int))
+	}
+	if n := atomic.LoadInt32(badCalls); n > 1 {
+		t.Fatalf("expect the failing server to be avoided, got %d of 20 calls", n)
+	}
+}
+
+func TestXClient_trailer(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b", "c"} {
+		addrs = append(addrs, serveFoo(t, Foo{name: name, calls: new(int32)}))
+	}
+	xc := NewXClient(NewMultiServerDiscovery(addrs), RandomSelect, nil,
+		WithIdempotent("Foo.Trailer"), WithFailMode(Forking), WithForks(3))
+	defer func() { _ = xc.Close() }()
+
+	//所有调用共享一个ctx，trailer会被同时写入
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			trailer := make(Metadata)
+			if err := xc.Broadcast(WithTrailer(context.Background(), trailer), "Foo.Trailer", i, new(int)); err != nil {
+				t.Error(err)
+				return
+			}
+			if len(trailer) != 3 || trailer["from-a"] != strconv.Itoa(i) {
+				t.Errorf("expect the trailers of all servers, got %v", trailer)
+			}
+			//Forking只合并胜出的调用的trailer
+			trailer = make(Metadata)
+			if err := xc.Call(WithTrailer(context.Background(), trailer), "Foo.Trailer", i, new(int)); err != nil {
+				t.Error(err)
+				return
+			}
+			if len(trailer) != 1 {
+				t.Errorf("expect the trailer of the winner, got %v", trailer)
+			}
+		}(i)
+	}
+	wg.Wait()
+}